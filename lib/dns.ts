@@ -1,4 +1,6 @@
 export type DnsRecord = {
+  name: string,
+  nameUnicode: string,
   type: "A" | "NS" | "CNAME" | "SOA" | "PTR" | "MX" | "TXT" | "SIG" | "KEY" | "AAAA" | "SRV" | "NAPTR" | "DS" | "DNSKEY" | "CAA",
   data: string,
   ttl: number
@@ -1,9 +1,11 @@
-export type DomainInfoType = "auto" | "rdap" | "whois";
+export type DomainInfoType = "auto" | "rdap" | "whois" | "merged";
+export type DomainInfoMergeSource = "registry-rdap" | "registrar-rdap" | "registry-whois" | "registrar-whois";
 export type DomainInfoSource = "auto" | "registry" | "registrar";
 
 export type DomainInfoResponse = {
   source: string,
   domain: string,
+  domainUnicode: string,
   registrar: string,
   statuses: string[],
   nameservers: string[],
@@ -12,5 +14,19 @@ export type DomainInfoResponse = {
   registryExpirationDate: Date | null,
   registrarExpirationDate: Date | null,
   registrantName: string | null,
-  dnssec: boolean
+  registrantPrivacy: "redacted" | "proxy" | "public" | "private-suffix",
+  privacyService: string | null,
+  registrarIanaId?: number,
+  registrarDetails?: { ianaId: number, name: string, status?: string, rdapUrl?: string, whoisServer?: string, website?: string },
+  dnssec: boolean,
+  dsData?: { keyTag: number, algorithm: number, digestType: number, digest: string }[],
+  query: string,
+  publicSuffix: { suffix: string, private: boolean, registrableDomain?: string, operator?: string },
+  whoisChain?: { source: DomainInfoMergeSource, server: string, error?: string }[],
+  timedOut?: ("registry" | "registrar" | "whois" | "dns")[],
+  idnWarnings?: { label: string, kind: "mixed-script" | "confusable", detail: string }[],
+  provenance?: Record<string, DomainInfoMergeSource>,
+  sources?: Partial<Record<DomainInfoMergeSource, string>>,
+  conflicts?: { field: string, values: Partial<Record<DomainInfoMergeSource, unknown>> }[],
+  raw?: { source: DomainInfoMergeSource, server: string, status?: number, json?: unknown, text?: string }[]
 };
\ No newline at end of file
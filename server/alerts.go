@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var alertStateBucket = []byte("alert-state")
+
+// alertTimeout bounds delivering one alert to one sink.
+const alertTimeout = 10 * time.Second
+
+type AlertKind string
+
+const (
+	alertExpiry             AlertKind = "expiry"
+	alertExpiryDisagreement AlertKind = "expiry-disagreement"
+)
+
+// Alert is a notification about a watched domain, sent to every configured AlertSink.
+type Alert struct {
+	Kind    AlertKind     `json:"kind"`
+	EntryId string        `json:"entryId"`
+	Domain  string        `json:"domain"`
+	Time    time.Time     `json:"time"`
+	Message string        `json:"message"`
+	Expiry  *ExpiryStatus `json:"expiry,omitempty"`
+}
+
+// AlertSink delivers alerts somewhere a person will see them.
+type AlertSink interface {
+	Name() string
+	Send(ctx context.Context, alert Alert) error
+}
+
+var alertHttpClient = &http.Client{Timeout: alertTimeout}
+
+func postJson(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := alertHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookSink posts the Alert as JSON.
+type webhookSink struct {
+	url string
+}
+
+func (s webhookSink) Name() string { return "webhook" }
+
+func (s webhookSink) Send(ctx context.Context, alert Alert) error {
+	return postJson(ctx, s.url, alert)
+}
+
+// slackSink posts the alert's message to a Slack incoming webhook, or anything that accepts the same payload.
+type slackSink struct {
+	url string
+}
+
+func (s slackSink) Name() string { return "slack" }
+
+func (s slackSink) Send(ctx context.Context, alert Alert) error {
+	return postJson(ctx, s.url, map[string]string{"text": alert.Message})
+}
+
+// smtpSink emails the alert. net/smtp only sends credentials over TLS or to localhost.
+type smtpSink struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+func (s smtpSink) Name() string { return "smtp" }
+
+func (s smtpSink) Send(ctx context.Context, alert Alert) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [domain-info] %s: %s\r\n", alert.Domain, alert.Kind)
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(alert.Message + "\r\n")
+
+	// smtp.SendMail doesn't take a context, so the best we can do is stop waiting for it
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(s.addr, s.auth, s.from, s.to, []byte(msg.String()))
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// alertSinks sets up a sink for each destination in c.
+func alertSinks(c AlertConfig) []AlertSink {
+	var sinks []AlertSink
+
+	if c.WebhookUrl != "" {
+		sinks = append(sinks, webhookSink{url: c.WebhookUrl})
+	}
+	if c.SlackWebhookUrl != "" {
+		sinks = append(sinks, slackSink{url: c.SlackWebhookUrl})
+	}
+	if c.Smtp.Addr != "" {
+		sink := smtpSink{addr: c.Smtp.Addr, from: c.Smtp.From, to: c.Smtp.To}
+		if c.Smtp.Username != "" {
+			host, _, _ := strings.Cut(c.Smtp.Addr, ":")
+			sink.auth = smtp.PlainAuth("", c.Smtp.Username, c.Smtp.Password, host)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks
+}
+
+// alertState remembers which alerts were already sent for an entry, so each one goes out once rather than on
+// every run.
+type alertState struct {
+	// ExpirationDate is the date the sent thresholds were for. Renewing the domain moves it and starts over.
+	ExpirationDate time.Time `json:"expirationDate"`
+	SentDays       []int     `json:"sentDays"`
+	// Expired is set once the alert that the domain has expired is sent, which comes after every threshold's.
+	Expired bool `json:"expired"`
+	// Disagreement is set while the registry and registrar disagree and that's been sent.
+	Disagreement bool `json:"disagreement"`
+}
+
+func (s *Store) alertState(id string) (alertState, error) {
+	var state alertState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(alertStateBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &state)
+	})
+	return state, err
+}
+
+func (s *Store) putAlertState(id string, state alertState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(alertStateBucket).Put([]byte(id), data)
+	})
+}
+
+// Alerter turns expiry check results into alerts. It's registered with the Scheduler with OnRun.
+type Alerter struct {
+	store *Store
+	sinks []AlertSink
+}
+
+func NewAlerter(store *Store, sinks []AlertSink) *Alerter {
+	return &Alerter{store: store, sinks: sinks}
+}
+
+func (a *Alerter) observe(ctx context.Context, entry WatchEntry, run WatchRun) {
+	for _, result := range run.Results {
+		if result.Check == checkExpiry && result.Expiry != nil {
+			if err := a.checkExpiry(ctx, entry, run, *result.Expiry); err != nil {
+				loggerFrom(ctx).Error("failed to send expiry alerts", "domain", entry.Domain, "err", err)
+			}
+		}
+	}
+}
+
+func (a *Alerter) checkExpiry(ctx context.Context, entry WatchEntry, run WatchRun, status ExpiryStatus) error {
+	state, err := a.store.alertState(entry.Id)
+	if err != nil {
+		return err
+	}
+	if !state.ExpirationDate.Equal(status.ExpirationDate) {
+		state.ExpirationDate = status.ExpirationDate
+		state.SentDays = nil
+		state.Expired = false
+	}
+
+	var errs []error
+	var message string
+	switch {
+	case status.DaysLeft < 0:
+		if !state.Expired {
+			message = fmt.Sprintf("%s expired on %s", entry.Domain, status.ExpirationDate.Format(time.DateOnly))
+		}
+	case status.Threshold > 0 && !slices.Contains(state.SentDays, status.Threshold):
+		message = fmt.Sprintf("%s expires in %d days, on %s", entry.Domain, status.DaysLeft, status.ExpirationDate.Format(time.DateOnly))
+	}
+	if message != "" {
+		err := a.send(ctx, Alert{Kind: alertExpiry, EntryId: entry.Id, Domain: entry.Domain, Time: run.Time, Message: message, Expiry: &status})
+		if err == nil {
+			state.Expired = status.DaysLeft < 0
+			// A domain that's first seen 5 days out shouldn't then get the 30 and 60 day alerts too
+			for _, days := range entry.Expiry.Days {
+				if days >= status.Threshold && !slices.Contains(state.SentDays, days) {
+					state.SentDays = append(state.SentDays, days)
+				}
+			}
+		}
+		errs = append(errs, err)
+	}
+
+	if status.Disagrees && !state.Disagreement {
+		message := fmt.Sprintf("the registry says %s expires on %s, but the registrar says %s", entry.Domain,
+			status.RegistryExpirationDate.Format(time.DateOnly), status.RegistrarExpirationDate.Format(time.DateOnly))
+
+		err := a.send(ctx, Alert{Kind: alertExpiryDisagreement, EntryId: entry.Id, Domain: entry.Domain, Time: run.Time, Message: message, Expiry: &status})
+		state.Disagreement = err == nil
+		errs = append(errs, err)
+	} else if !status.Disagrees {
+		state.Disagreement = false
+	}
+
+	return errors.Join(append(errs, a.store.putAlertState(entry.Id, state))...)
+}
+
+// send delivers alert to every sink. It only counts as sent if at least one of them took it, otherwise it's retried
+// on the next run.
+func (a *Alerter) send(ctx context.Context, alert Alert) error {
+	var errs []error
+	for _, sink := range a.sinks {
+		sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), alertTimeout)
+		err := sink.Send(sendCtx, alert)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+
+	if len(errs) == len(a.sinks) && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		loggerFrom(ctx).Warn("failed to send alert", "kind", alert.Kind, "domain", alert.Domain, "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAlert = Alert{
+	Kind:    alertExpiry,
+	EntryId: "0123456789abcdef",
+	Domain:  "example.com",
+	Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	Message: "example.com expires in 7 days, on 2024-05-08",
+}
+
+// jsonReceiver is a stand-in for a webhook, which decodes what's posted to it into a new T.
+func jsonReceiver[T any](t *testing.T, status int) (*httptest.Server, <-chan T) {
+	received := make(chan T, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("got Content-Type %q, want application/json", ct)
+		}
+		var body T
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		received <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestWebhookSink(t *testing.T) {
+	server, received := jsonReceiver[Alert](t, http.StatusNoContent)
+
+	if err := (webhookSink{url: server.URL}).Send(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !reflect.DeepEqual(got, testAlert) {
+		t.Errorf("got %+v, want %+v", got, testAlert)
+	}
+}
+
+func TestWebhookSinkRejected(t *testing.T) {
+	server, _ := jsonReceiver[Alert](t, http.StatusInternalServerError)
+
+	if err := (webhookSink{url: server.URL}).Send(context.Background(), testAlert); err == nil {
+		t.Error("got no error from a webhook that responded with 500")
+	}
+}
+
+func TestSlackSink(t *testing.T) {
+	server, received := jsonReceiver[map[string]string](t, http.StatusOK)
+
+	if err := (slackSink{url: server.URL}).Send(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-received, map[string]string{"text": testAlert.Message}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// smtpMessage is what fakeSmtpServer was sent.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSmtpServer accepts one message the way net/smtp sends it, without STARTTLS or AUTH, and returns its address.
+func fakeSmtpServer(t *testing.T) (string, <-chan smtpMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(alertTimeout))
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		var msg smtpMessage
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb, arg, _ := strings.Cut(line, " ")
+
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL":
+				msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+				reply("250 OK")
+			case "RCPT":
+				msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+				reply("250 OK")
+			case "DATA":
+				reply("354 Go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				msg.data = data.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				received <- msg
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestSmtpSink(t *testing.T) {
+	addr, received := fakeSmtpServer(t)
+	sink := smtpSink{addr: addr, from: "alerts@example.net", to: []string{"ops@example.net", "dns@example.net"}}
+
+	if err := sink.Send(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-received
+	if got.from != sink.from || !reflect.DeepEqual(got.to, sink.to) {
+		t.Errorf("got envelope from %q to %v, want from %q to %v", got.from, got.to, sink.from, sink.to)
+	}
+	for _, want := range []string{
+		"From: alerts@example.net\r\n",
+		"To: ops@example.net, dns@example.net\r\n",
+		"Subject: [domain-info] example.com: expiry\r\n",
+		"\r\n\r\n" + testAlert.Message + "\r\n",
+	} {
+		if !strings.Contains(got.data, want) {
+			t.Errorf("message doesn't contain %q:\n%s", want, got.data)
+		}
+	}
+}
+
+// recordingSink keeps the alerts sent to it, and fails while failing is set.
+type recordingSink struct {
+	alerts  []Alert
+	failing bool
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Send(_ context.Context, alert Alert) error {
+	if s.failing {
+		return errors.New("unavailable")
+	}
+	s.alerts = append(s.alerts, alert)
+	return nil
+}
+
+func TestAlerterExpiry(t *testing.T) {
+	expiry := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	renewed := expiry.AddDate(1, 0, 0)
+
+	// observation is one run of the expiry check, daysLeft days before the domain expires on expirationDate
+	type observation struct {
+		daysLeft       int
+		expirationDate time.Time
+		sinkFails      bool
+	}
+	tests := []struct {
+		name         string
+		observations []observation
+		// want are the messages of the alerts sent, in order
+		want []string
+	}{
+		{
+			name:         "outside every threshold",
+			observations: []observation{{daysLeft: 90, expirationDate: expiry}, {daysLeft: 61, expirationDate: expiry}},
+		},
+		{
+			name: "each threshold once",
+			observations: []observation{
+				{daysLeft: 59, expirationDate: expiry},
+				{daysLeft: 45, expirationDate: expiry},
+				{daysLeft: 30, expirationDate: expiry},
+				{daysLeft: 20, expirationDate: expiry},
+				{daysLeft: 7, expirationDate: expiry},
+				{daysLeft: 1, expirationDate: expiry},
+			},
+			want: []string{
+				"example.com expires in 59 days, on 2024-06-01",
+				"example.com expires in 30 days, on 2024-06-01",
+				"example.com expires in 7 days, on 2024-06-01",
+			},
+		},
+		{
+			name:         "first seen close to expiry skips the earlier thresholds",
+			observations: []observation{{daysLeft: 5, expirationDate: expiry}, {daysLeft: 4, expirationDate: expiry}},
+			want:         []string{"example.com expires in 5 days, on 2024-06-01"},
+		},
+		{
+			name: "expired after the last threshold",
+			observations: []observation{
+				{daysLeft: 3, expirationDate: expiry},
+				{daysLeft: -1, expirationDate: expiry},
+				{daysLeft: -2, expirationDate: expiry},
+			},
+			want: []string{
+				"example.com expires in 3 days, on 2024-06-01",
+				"example.com expired on 2024-06-01",
+			},
+		},
+		{
+			name:         "first seen expired",
+			observations: []observation{{daysLeft: -10, expirationDate: expiry}, {daysLeft: 3, expirationDate: expiry}},
+			want:         []string{"example.com expired on 2024-06-01"},
+		},
+		{
+			name: "renewing starts over",
+			observations: []observation{
+				{daysLeft: 6, expirationDate: expiry},
+				{daysLeft: -1, expirationDate: expiry},
+				{daysLeft: 6, expirationDate: renewed},
+			},
+			want: []string{
+				"example.com expires in 6 days, on 2024-06-01",
+				"example.com expired on 2024-06-01",
+				"example.com expires in 6 days, on 2025-06-01",
+			},
+		},
+		{
+			name: "failed alerts are retried",
+			observations: []observation{
+				{daysLeft: 29, expirationDate: expiry, sinkFails: true},
+				{daysLeft: 28, expirationDate: expiry},
+				{daysLeft: 27, expirationDate: expiry},
+			},
+			want: []string{"example.com expires in 28 days, on 2024-06-01"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := OpenStore(filepath.Join(t.TempDir(), "store.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			sink := &recordingSink{}
+			alerter := NewAlerter(store, []AlertSink{sink})
+			entry := WatchEntry{Id: "0123456789abcdef", Domain: "example.com", Expiry: ExpiryRules{Days: []int{60, 30, 7}}}
+
+			for _, observed := range test.observations {
+				status := ExpiryStatus{ExpirationDate: observed.expirationDate, DaysLeft: observed.daysLeft}
+				for _, days := range entry.Expiry.Days {
+					if status.DaysLeft <= days {
+						status.Threshold = days
+					}
+				}
+				run := WatchRun{
+					EntryId: entry.Id,
+					Domain:  entry.Domain,
+					Time:    observed.expirationDate.AddDate(0, 0, -observed.daysLeft),
+					Results: []WatchResult{{Check: checkExpiry, Ok: true, Expiry: &status}},
+				}
+
+				sink.failing = observed.sinkFails
+				alerter.observe(context.Background(), entry, run)
+			}
+
+			var got []string
+			for _, alert := range sink.alerts {
+				got = append(got, alert.Message)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got alerts %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// watchRunner runs the checks of one entry. Checks share the lookups they have in common, so an entry with every
+// check enabled only asks the registry and each nameserver once.
+type watchRunner struct {
+	entry WatchEntry
+	time  time.Time
+
+	infoDone bool
+	info     DomainInfo
+	infoErr  error
+
+	records map[string]dnsLookup
+}
+
+type dnsLookup struct {
+	records  map[string][]DnsRecord
+	timedOut []string
+	err      error
+}
+
+func runChecks(ctx context.Context, entry WatchEntry) WatchRun {
+	r := &watchRunner{
+		entry:   entry,
+		time:    time.Now(),
+		records: make(map[string]dnsLookup),
+	}
+	run := WatchRun{
+		EntryId: entry.Id,
+		Domain:  entry.Domain,
+		Time:    r.time,
+		Results: make([]WatchResult, 0, len(entry.Checks)),
+	}
+
+	for _, check := range entry.Checks {
+		switch check {
+		case checkInfo:
+			run.Results = append(run.Results, r.checkInfo(ctx))
+		case checkDns:
+			for _, hostname := range entry.Hostnames {
+				run.Results = append(run.Results, r.checkDns(ctx, hostname))
+			}
+		case checkDnssec:
+			run.Results = append(run.Results, r.checkDnssec(ctx))
+		case checkDelegation:
+			run.Results = append(run.Results, r.checkDelegation(ctx))
+		case checkExpiry:
+			run.Results = append(run.Results, r.checkExpiry(ctx))
+		case checkDs:
+			run.Results = append(run.Results, r.checkDs(ctx))
+		}
+	}
+
+	return run
+}
+
+func (r *watchRunner) getInfo(ctx context.Context) (DomainInfo, error) {
+	if !r.infoDone {
+		r.info, r.infoErr = GetInfo(ctx, r.entry.Domain, InfoOptions{})
+		r.infoDone = true
+	}
+	return r.info, r.infoErr
+}
+
+// getRecords asks every nameserver the registry has for the domain about hostname.
+func (r *watchRunner) getRecords(ctx context.Context, hostname string) (map[string][]DnsRecord, []string, error) {
+	if lookup, ok := r.records[hostname]; ok {
+		return lookup.records, lookup.timedOut, lookup.err
+	}
+
+	var lookup dnsLookup
+	info, err := r.getInfo(ctx)
+	if err != nil {
+		lookup.err = err
+	} else if len(info.Nameservers) == 0 {
+		lookup.err = newLookupError(ErrCodeNotFound, fmt.Errorf("%s has no nameservers", info.Domain))
+	} else {
+		lookup.records, lookup.timedOut, lookup.err = GetDnsRecordsFromNs(ctx, hostname, info.Nameservers, true)
+	}
+
+	r.records[hostname] = lookup
+	return lookup.records, lookup.timedOut, lookup.err
+}
+
+func failedResult(check WatchCheck, err error) WatchResult {
+	return WatchResult{Check: check, Code: ErrorCodeOf(err), Error: err.Error()}
+}
+
+func (result WatchResult) finish() WatchResult {
+	result.Ok = result.Error == "" && len(result.Issues) == 0
+	return result
+}
+
+// checkInfo looks the domain up and reports how it changed since the last time it was recorded.
+func (r *watchRunner) checkInfo(ctx context.Context) WatchResult {
+	info, err := r.getInfo(ctx)
+	if err != nil {
+		return failedResult(checkInfo, err)
+	}
+
+	result := WatchResult{Check: checkInfo}
+	for _, stage := range info.TimedOut {
+		result.Issues = append(result.Issues, fmt.Sprintf("%s lookup timed out", stage))
+	}
+
+	previous, err := store.InfoHistory(info.Domain, r.time, 1)
+	if err != nil {
+		return failedResult(checkInfo, err)
+	}
+	if err := store.RecordInfo(info, r.time); err != nil {
+		return failedResult(checkInfo, err)
+	}
+	if len(previous) > 0 && len(info.TimedOut) == 0 {
+		result.Changes = diffInfo(previous[0].Info, info)
+	}
+
+	return result.finish()
+}
+
+// checkDns asks every nameserver about hostname and reports which records changed since the last time it was
+// recorded.
+func (r *watchRunner) checkDns(ctx context.Context, hostname string) WatchResult {
+	result, err := r.diffRecords(ctx, hostname)
+	if err != nil {
+		result = failedResult(checkDns, err)
+	}
+	result.Hostname = hostname
+	return result.finish()
+}
+
+func (r *watchRunner) diffRecords(ctx context.Context, hostname string) (WatchResult, error) {
+	records, timedOut, err := r.getRecords(ctx, hostname)
+	if err != nil {
+		return WatchResult{}, err
+	}
+
+	result := WatchResult{Check: checkDns}
+	for _, server := range timedOut {
+		result.Issues = append(result.Issues, fmt.Sprintf("%s timed out", server))
+	}
+
+	previous, err := store.DnsHistory(hostname, r.time, 1)
+	if err != nil {
+		return WatchResult{}, err
+	}
+	if err := store.RecordDns(hostname, records, r.time); err != nil {
+		return WatchResult{}, err
+	}
+	if len(previous) > 0 {
+		result.RecordChanges = diffDns(previous[0].Records, records).Changes
+	}
+
+	return result, nil
+}
+
+// checkDnssec compares whether the registry publishes DS records for the domain with whether its nameservers serve
+// DNSKEYs. A DS without keys breaks resolution for validating resolvers, and keys without a DS mean the zone is
+// signed but nobody can validate it.
+func (r *watchRunner) checkDnssec(ctx context.Context) WatchResult {
+	info, err := r.getInfo(ctx)
+	if err != nil {
+		return failedResult(checkDnssec, err)
+	}
+	records, _, err := r.getRecords(ctx, info.Domain)
+	if err != nil {
+		return failedResult(checkDnssec, err)
+	}
+
+	var signed, unsigned []string
+	for _, server := range slices.Sorted(maps.Keys(records)) {
+		if slices.ContainsFunc(records[server], func(record DnsRecord) bool { return record.Type == "DNSKEY" }) {
+			signed = append(signed, server)
+		} else {
+			unsigned = append(unsigned, server)
+		}
+	}
+
+	result := WatchResult{Check: checkDnssec}
+	switch {
+	case len(signed) > 0 && len(unsigned) > 0:
+		result.Issues = append(result.Issues, fmt.Sprintf("%s serve DNSKEY records but %s don't",
+			strings.Join(signed, ", "), strings.Join(unsigned, ", ")))
+	case info.Dnssec && len(signed) == 0:
+		result.Issues = append(result.Issues, "the registry has DS records but no nameserver serves DNSKEY records, so validating resolvers will fail to resolve the domain")
+	case !info.Dnssec && len(signed) > 0:
+		result.Issues = append(result.Issues, "the zone is signed but the registry has no DS records, so it can't be validated")
+	}
+
+	return result.finish()
+}
+
+// checkDelegation makes sure every nameserver the registry delegates to resolves, answers authoritatively for the
+// domain, and serves the same SOA serial as the others.
+func (r *watchRunner) checkDelegation(ctx context.Context) WatchResult {
+	info, err := r.getInfo(ctx)
+	if err != nil {
+		return failedResult(checkDelegation, err)
+	}
+
+	result := WatchResult{Check: checkDelegation}
+	if len(info.Nameservers) < 2 {
+		result.Issues = append(result.Issues, fmt.Sprintf("only %d nameserver(s) are delegated, at least 2 are recommended", len(info.Nameservers)))
+	}
+
+	res := newResolver(ctx)
+	client := new(dns.Client)
+	serials := make(map[uint32][]string)
+	for _, nameserver := range info.Nameservers {
+		nameserver = normalizeNameserver(nameserver)
+
+		resolveCtx, cancel := stageContext(ctx, StageDns)
+		addrs, _, err := res.Resolve(resolveCtx, nameserver)
+		cancel()
+		if err != nil {
+			result.Issues = append(result.Issues, fmt.Sprintf("%s doesn't resolve: %s", nameserver, err))
+			continue
+		}
+
+		for _, addr := range addrs {
+			server := fmt.Sprintf("%s (%s)", nameserver, addr)
+			serial, err := querySoaSerial(ctx, client, info.Domain, addr)
+			if err != nil {
+				result.Issues = append(result.Issues, fmt.Sprintf("%s: %s", server, err))
+				continue
+			}
+			serials[serial] = append(serials[serial], server)
+		}
+	}
+
+	if len(serials) > 1 {
+		var parts []string
+		for _, serial := range slices.Sorted(maps.Keys(serials)) {
+			parts = append(parts, fmt.Sprintf("%d from %s", serial, strings.Join(serials[serial], ", ")))
+		}
+		result.Issues = append(result.Issues, "nameservers disagree on the SOA serial: "+strings.Join(parts, "; "))
+	}
+
+	return result.finish()
+}
+
+// ExpiryStatus is what the expiry check found. Threshold is the smallest of the entry's ExpiryRules.Days that the
+// domain is within, or 0 if it isn't within any of them yet.
+type ExpiryStatus struct {
+	ExpirationDate          time.Time  `json:"expirationDate"`
+	DaysLeft                int        `json:"daysLeft"`
+	Threshold               int        `json:"threshold,omitempty"`
+	RegistryExpirationDate  *time.Time `json:"registryExpirationDate"`
+	RegistrarExpirationDate *time.Time `json:"registrarExpirationDate"`
+	// DisagreementDays is how far apart the registry and registrar dates are, if they're both known.
+	DisagreementDays int `json:"disagreementDays,omitempty"`
+	// Disagrees is set when DisagreementDays is more than the entry's ExpiryRules.MaxDisagreementDays.
+	Disagrees bool `json:"disagrees,omitempty"`
+}
+
+// checkDs relates the zone's keys to the DS records its parent serves and its registry lists, and reports where a
+// rollover through CDS and CDNSKEY records stands. A rollover that's pending isn't an issue; one that's broken is.
+func (r *watchRunner) checkDs(ctx context.Context) WatchResult {
+	info, err := r.getInfo(ctx)
+	if err != nil {
+		return failedResult(checkDs, err)
+	}
+	report, err := GetDsReport(ctx, info)
+	if err != nil {
+		return failedResult(checkDs, err)
+	}
+
+	result := WatchResult{Check: checkDs, Issues: report.Issues, Ds: &report}
+	return result.finish()
+}
+
+// checkExpiry compares the earlier of the registry and registrar expiration dates against the entry's rules. The
+// earlier one is what matters, since either side letting the domain lapse loses it.
+func (r *watchRunner) checkExpiry(ctx context.Context) WatchResult {
+	info, err := r.getInfo(ctx)
+	if err != nil {
+		return failedResult(checkExpiry, err)
+	}
+
+	registry, registrar := info.RegistryExpirationDate, info.RegistrarExpirationDate
+	if registry == nil && registrar == nil {
+		return failedResult(checkExpiry, newLookupError(ErrCodeNotFound, errors.New("neither the registry nor the registrar returned an expiration date")))
+	}
+
+	status := &ExpiryStatus{
+		RegistryExpirationDate:  registry,
+		RegistrarExpirationDate: registrar,
+	}
+	switch {
+	case registry == nil:
+		status.ExpirationDate = *registrar
+	case registrar == nil || registry.Before(*registrar):
+		status.ExpirationDate = *registry
+	default:
+		status.ExpirationDate = *registrar
+	}
+	status.DaysLeft = int(math.Floor(status.ExpirationDate.Sub(r.time).Hours() / 24))
+
+	result := WatchResult{Check: checkExpiry, Expiry: status}
+	thresholds := r.entry.Expiry.Days
+	if len(thresholds) == 0 {
+		thresholds = defaultExpiryDays
+	}
+	for _, days := range thresholds {
+		if status.DaysLeft <= days {
+			status.Threshold = days
+		}
+	}
+	if status.DaysLeft < 0 {
+		result.Issues = append(result.Issues, fmt.Sprintf("expired on %s", status.ExpirationDate.Format(time.DateOnly)))
+	} else if status.Threshold > 0 {
+		result.Issues = append(result.Issues, fmt.Sprintf("expires in %d days on %s", status.DaysLeft, status.ExpirationDate.Format(time.DateOnly)))
+	}
+
+	if registry != nil && registrar != nil {
+		status.DisagreementDays = int(registry.Sub(*registrar).Abs().Hours() / 24)
+		maxDays := r.entry.Expiry.MaxDisagreementDays
+		if maxDays > 0 && status.DisagreementDays > maxDays {
+			status.Disagrees = true
+			result.Issues = append(result.Issues, fmt.Sprintf("the registry says it expires on %s but the registrar says %s",
+				registry.Format(time.DateOnly), registrar.Format(time.DateOnly)))
+		}
+	}
+
+	return result.finish()
+}
+
+var errLameDelegation = errors.New("not authoritative for the domain (lame delegation)")
+
+// querySoaSerial asks the server at addr for domain's SOA without recursion, so only an authoritative answer counts.
+func querySoaSerial(ctx context.Context, client *dns.Client, domain string, addr netip.Addr) (uint32, error) {
+	resp, err := queryServer(ctx, client, domain, dns.TypeSOA, addr)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	if !resp.Authoritative {
+		return 0, errLameDelegation
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("answered without an SOA record")
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the server can be configured with. It starts from defaultConfig, then the YAML file given
+// with -config or CONFIG_FILE is applied on top, then environment variables, then the rest of the flags.
+type Config struct {
+	// Listen is the address the HTTP server listens on.
+	Listen string    `yaml:"listen"`
+	Tls    TlsConfig `yaml:"tls"`
+	DbPath string    `yaml:"dbPath"`
+
+	Log     LogConfig     `yaml:"log"`
+	Tracing TracingConfig `yaml:"tracing"`
+
+	// SourceIps are the local addresses RDAP and WHOIS queries are made from. Empty means the system picks.
+	SourceIps []string `yaml:"sourceIps"`
+	// SourceStrategy is how each query's address is picked from SourceIps.
+	SourceStrategy string `yaml:"sourceStrategy"`
+	// SourceCooldown is how long an address rests from an upstream that rate limited it.
+	SourceCooldown time.Duration `yaml:"sourceCooldown"`
+
+	Timeouts TimeoutConfig  `yaml:"timeouts"`
+	Resolver ResolverConfig `yaml:"resolver"`
+	Rdap     RdapConfig     `yaml:"rdap"`
+	Whois    WhoisConfig    `yaml:"whois"`
+	// Registrars is IANA's registrar list, which fills in details lookups leave out and serves /registrar.
+	Registrars RegistrarConfig `yaml:"registrars"`
+	// Tlds adds what we know about TLDs, or zones under them like co.uk, to what zonedb does for /tld.
+	Tlds map[string]TldOverride `yaml:"tlds"`
+	// PrivateSuffixes names who runs private suffixes, like github.io, beyond the ones we know of.
+	PrivateSuffixes map[string]string `yaml:"privateSuffixes"`
+	// Upstreams tunes how we talk to particular servers, keyed by hostname or IP as it appears in the metrics.
+	Upstreams  map[string]UpstreamProfile `yaml:"upstreams"`
+	RateLimits RateLimitConfig            `yaml:"rateLimits"`
+	Cache      CacheConfig                `yaml:"cache"`
+
+	// Retention bounds the lookup history, watch results and event deliveries the store keeps.
+	Retention RetentionConfig `yaml:"retention"`
+
+	Watch  WatchConfig `yaml:"watch"`
+	Alerts AlertConfig `yaml:"alerts"`
+	Events EventConfig `yaml:"events"`
+}
+
+type TlsConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+func (c TlsConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format"`
+}
+
+type TracingConfig struct {
+	// Exporter is otlp, stdout or none. The OTLP exporter is configured by the standard OTEL_EXPORTER_OTLP_*
+	// variables.
+	Exporter string `yaml:"exporter"`
+}
+
+type TimeoutConfig struct {
+	// Request bounds a whole request when the client doesn't pass `timeout=`.
+	Request time.Duration `yaml:"request"`
+	// MaxRequest is the largest `timeout=` we accept, so a client can't pin upstream connections forever.
+	MaxRequest time.Duration `yaml:"maxRequest"`
+	// Stages is the budget for each stage of a lookup. Stages that aren't given keep their default.
+	Stages StageTimeouts `yaml:"stages"`
+}
+
+type ResolverConfig struct {
+	// UdpTimeout is how long to wait for a UDP response before retrying over TCP.
+	UdpTimeout time.Duration `yaml:"udpTimeout"`
+	// MaxDepth is how deep from the root nameservers a resolution can recurse.
+	MaxDepth int  `yaml:"maxDepth"`
+	NoIpv6   bool `yaml:"noIpv6"`
+	// CacheSize caps the responses each resolution keeps around. 0 means no limit.
+	CacheSize int `yaml:"cacheSize"`
+}
+
+type RdapConfig struct {
+	// BootstrapUrl is where IANA's DNS bootstrap registry is downloaded from.
+	BootstrapUrl string `yaml:"bootstrapUrl"`
+	// BootstrapFile keeps a copy of the registry, so it's loaded from disk at startup rather than downloaded.
+	// Empty keeps it in memory only.
+	BootstrapFile string `yaml:"bootstrapFile"`
+	// BootstrapRefresh is how often the registry is downloaded again. 0 never refreshes it once it's loaded.
+	BootstrapRefresh time.Duration `yaml:"bootstrapRefresh"`
+	// Servers maps TLDs, or longer suffixes, to the RDAP base URL to use for them instead of the registry's.
+	Servers map[string]string `yaml:"servers"`
+}
+
+type WhoisConfig struct {
+	// Servers maps TLDs, or longer suffixes, to the WHOIS server to ask first instead of the one we'd otherwise pick.
+	Servers map[string]string `yaml:"servers"`
+	// QueryFormats is how to phrase the query for servers that need more than the bare domain, by hostname.
+	// "{domain}" is replaced with the domain.
+	QueryFormats map[string]string `yaml:"queryFormats"`
+	// MaxReferrals is how many referrals past the first server are followed.
+	MaxReferrals int `yaml:"maxReferrals"`
+}
+
+type RegistrarConfig struct {
+	// Url is where IANA's registrar list (CSV) is downloaded from. Empty only reads File, so the list can be kept up
+	// to date offline.
+	Url string `yaml:"url"`
+	// File keeps a copy of the list, so it's loaded from disk at startup rather than downloaded. Empty keeps it in
+	// memory only. Without Url and File, the directory is the built-in seed (names only) and Overrides.
+	File string `yaml:"file"`
+	// Refresh is how often the list is downloaded, or File reread, again. 0 never refreshes it once it's loaded.
+	Refresh time.Duration `yaml:"refresh"`
+	// Overrides add to or correct registrars by IANA ID, like the WHOIS servers and websites IANA doesn't list.
+	Overrides map[int]RegistrarOverride `yaml:"overrides"`
+}
+
+// RegistrarOverride replaces the fields of a registrar's entry that it sets.
+type RegistrarOverride struct {
+	Name        string `yaml:"name"`
+	RdapUrl     string `yaml:"rdapUrl"`
+	WhoisServer string `yaml:"whoisServer"`
+	Website     string `yaml:"website"`
+}
+
+type TldOverride struct {
+	// Operator is the registry operator, which zonedb doesn't know.
+	Operator string `yaml:"operator"`
+	// Tags are added to zonedb's.
+	Tags []string `yaml:"tags"`
+	// Notes are for staff, like quirks of the registry's transfer process.
+	Notes string `yaml:"notes"`
+}
+
+// UpstreamProfile overrides the defaults for one upstream server.
+type UpstreamProfile struct {
+	// Timeout bounds each query to the server, within the stage's budget. 0 leaves it to the stage.
+	Timeout   time.Duration `yaml:"timeout"`
+	RateLimit *RateLimit    `yaml:"rateLimit"`
+}
+
+type RateLimitConfig struct {
+	// Defaults are the limits for each host, by kind of upstream: rdap, whois, dns or resolver.
+	Defaults map[string]RateLimit `yaml:"defaults"`
+	// Backoff is how long we leave a server alone after it says we've hit its limit anyway.
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+// CacheConfig is for the /info cache.
+type CacheConfig struct {
+	// Size is how many results are kept. 0 turns the cache off.
+	Size int `yaml:"size"`
+	// Ttl is how long a result is served without asking upstream again. 0 turns the cache off.
+	Ttl time.Duration `yaml:"ttl"`
+	// StaleWhileRevalidate is how long past Ttl a result is still served while it's refreshed in the background.
+	StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate"`
+}
+
+// RetentionConfig applies to each domain's or hostname's lookup history, and each watchlist entry's results and
+// event deliveries, on their own. Deliveries that are still being retried are kept regardless.
+type RetentionConfig struct {
+	// MaxAge is how long entries are kept. 0 keeps them however old they get.
+	MaxAge time.Duration `yaml:"maxAge"`
+	// MaxEntries is how many of the newest entries are kept. 0 keeps them all.
+	MaxEntries int `yaml:"maxEntries"`
+}
+
+type WatchConfig struct {
+	// Concurrency is how many watchlist entries are checked at once.
+	Concurrency int `yaml:"concurrency"`
+	// Jitter randomly spreads each entry's next run by up to this fraction of its interval.
+	Jitter float64 `yaml:"jitter"`
+}
+
+type AlertConfig struct {
+	WebhookUrl      string     `yaml:"webhookUrl"`
+	SlackWebhookUrl string     `yaml:"slackWebhookUrl"`
+	Smtp            SmtpConfig `yaml:"smtp"`
+}
+
+type SmtpConfig struct {
+	Addr     string   `yaml:"addr"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+}
+
+type EventConfig struct {
+	WebhookUrls []string `yaml:"webhookUrls"`
+	// WebhookSecret signs every delivery, and is required with WebhookUrls.
+	WebhookSecret string `yaml:"webhookSecret"`
+}
+
+// config is the server's configuration. It's replaced with the loaded one at startup.
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Listen: ":3333",
+		DbPath: "domain-info.db",
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			Exporter: "none",
+		},
+		SourceStrategy: string(sourceRoundRobin),
+		SourceCooldown: defaultSourceCooldown,
+		Timeouts: TimeoutConfig{
+			Request:    defaultRequestTimeout,
+			MaxRequest: maxRequestTimeout,
+			Stages:     maps.Clone(defaultStageTimeouts),
+		},
+		Resolver: ResolverConfig{
+			UdpTimeout: udpQueryTimeout,
+			MaxDepth:   maxDepth,
+			CacheSize:  defaultResolverCacheSize,
+		},
+		Rdap: RdapConfig{
+			BootstrapUrl:     defaultRdapBootstrapUrl,
+			BootstrapRefresh: defaultRdapBootstrapRefresh,
+		},
+		Whois: WhoisConfig{
+			QueryFormats: maps.Clone(defaultWhoisQueryFormats),
+			MaxReferrals: defaultWhoisMaxReferrals,
+		},
+		Registrars: RegistrarConfig{
+			Url:     defaultRegistrarsUrl,
+			Refresh: defaultRegistrarsRefresh,
+		},
+		RateLimits: RateLimitConfig{
+			Defaults: maps.Clone(defaultRateLimits),
+			Backoff:  defaultRateLimitBackoff,
+		},
+		Cache: CacheConfig{
+			Size:                 defaultInfoCacheSize,
+			Ttl:                  defaultInfoCacheTtl,
+			StaleWhileRevalidate: defaultInfoCacheStaleWhileRevalidate,
+		},
+		Retention: RetentionConfig{
+			MaxAge:     defaultRetentionMaxAge,
+			MaxEntries: defaultRetentionMax,
+		},
+		Watch: WatchConfig{
+			Concurrency: defaultWatchConcurrency,
+			Jitter:      defaultWatchJitter,
+		},
+	}
+}
+
+// loadConfig builds the configuration from args, the config file and the environment, and validates it.
+func loadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("domain-info", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	listen := fs.String("listen", "", "address to listen on")
+	dbPath := fs.String("db", "", "path to the database")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file")
+	tlsKey := fs.String("tls-key", "", "TLS key file")
+	sourceIps := fs.String("source-ip", "", "comma-separated local addresses to query upstreams from")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error")
+	logFormat := fs.String("log-format", "", "text or json")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	c := defaultConfig()
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return Config{}, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = *listen
+		case "db":
+			c.DbPath = *dbPath
+		case "tls-cert":
+			c.Tls.CertFile = *tlsCert
+		case "tls-key":
+			c.Tls.KeyFile = *tlsKey
+		case "source-ip":
+			c.SourceIps = splitList(*sourceIps)
+		case "log-level":
+			c.Log.Level = *logLevel
+		case "log-format":
+			c.Log.Format = *logFormat
+		}
+	})
+
+	if err := c.validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides c with whichever environment variables are set.
+func (c *Config) applyEnv() error {
+	var errs []error
+	str := func(name string, v *string) {
+		if s := os.Getenv(name); s != "" {
+			*v = s
+		}
+	}
+	list := func(name string, v *[]string) {
+		if s := os.Getenv(name); s != "" {
+			*v = splitList(s)
+		}
+	}
+	parse := func(name string, set func(string) error) {
+		if s := os.Getenv(name); s != "" {
+			if err := set(s); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q", name, s))
+			}
+		}
+	}
+
+	str("LISTEN_ADDR", &c.Listen)
+	str("TLS_CERT_FILE", &c.Tls.CertFile)
+	str("TLS_KEY_FILE", &c.Tls.KeyFile)
+	str("DB_PATH", &c.DbPath)
+
+	// VERBOSE used to turn on RDAP debug output, so it still means debug unless LOG_LEVEL says otherwise
+	parse("VERBOSE", func(s string) error {
+		verbose, err := strconv.ParseBool(s)
+		if verbose {
+			c.Log.Level = "debug"
+		}
+		return err
+	})
+	str("LOG_LEVEL", &c.Log.Level)
+	str("LOG_FORMAT", &c.Log.Format)
+	str("OTEL_TRACES_EXPORTER", &c.Tracing.Exporter)
+
+	list("SOURCE_IP", &c.SourceIps)
+	str("SOURCE_STRATEGY", &c.SourceStrategy)
+	parse("SOURCE_COOLDOWN", func(s string) (err error) {
+		c.SourceCooldown, err = time.ParseDuration(s)
+		return err
+	})
+	parse("REQUEST_TIMEOUT", func(s string) (err error) {
+		c.Timeouts.Request, err = time.ParseDuration(s)
+		return err
+	})
+	parse("MAX_REQUEST_TIMEOUT", func(s string) (err error) {
+		c.Timeouts.MaxRequest, err = time.ParseDuration(s)
+		return err
+	})
+
+	str("RDAP_BOOTSTRAP_URL", &c.Rdap.BootstrapUrl)
+	str("RDAP_BOOTSTRAP_FILE", &c.Rdap.BootstrapFile)
+	parse("RDAP_BOOTSTRAP_REFRESH", func(s string) (err error) {
+		c.Rdap.BootstrapRefresh, err = time.ParseDuration(s)
+		return err
+	})
+
+	str("REGISTRARS_URL", &c.Registrars.Url)
+	str("REGISTRARS_FILE", &c.Registrars.File)
+	parse("REGISTRARS_REFRESH", func(s string) (err error) {
+		c.Registrars.Refresh, err = time.ParseDuration(s)
+		return err
+	})
+
+	parse("RETENTION_MAX_AGE", func(s string) (err error) {
+		c.Retention.MaxAge, err = time.ParseDuration(s)
+		return err
+	})
+	parse("RETENTION_MAX_ENTRIES", func(s string) (err error) {
+		c.Retention.MaxEntries, err = strconv.Atoi(s)
+		return err
+	})
+
+	parse("WATCH_CONCURRENCY", func(s string) (err error) {
+		c.Watch.Concurrency, err = strconv.Atoi(s)
+		return err
+	})
+	parse("WATCH_JITTER", func(s string) (err error) {
+		c.Watch.Jitter, err = strconv.ParseFloat(s, 64)
+		return err
+	})
+
+	str("ALERT_WEBHOOK_URL", &c.Alerts.WebhookUrl)
+	str("ALERT_SLACK_WEBHOOK_URL", &c.Alerts.SlackWebhookUrl)
+	str("ALERT_SMTP_ADDR", &c.Alerts.Smtp.Addr)
+	str("ALERT_SMTP_FROM", &c.Alerts.Smtp.From)
+	list("ALERT_SMTP_TO", &c.Alerts.Smtp.To)
+	str("ALERT_SMTP_USERNAME", &c.Alerts.Smtp.Username)
+	str("ALERT_SMTP_PASSWORD", &c.Alerts.Smtp.Password)
+
+	list("EVENT_WEBHOOK_URLS", &c.Events.WebhookUrls)
+	str("EVENT_WEBHOOK_SECRET", &c.Events.WebhookSecret)
+
+	return errors.Join(errs...)
+}
+
+// validate checks everything that can be checked before the server starts, so a typo fails fast rather than on the
+// first request that needs it.
+func (c Config) validate() error {
+	var errs []error
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %q is not a valid address", c.Listen))
+	} else if _, err := net.LookupPort("tcp", port); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %q is not a valid port", port))
+	}
+	if c.Tls.enabled() {
+		if c.Tls.CertFile == "" || c.Tls.KeyFile == "" {
+			errs = append(errs, errors.New("tls: certFile and keyFile must be set together"))
+		} else if _, err := tls.LoadX509KeyPair(c.Tls.CertFile, c.Tls.KeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+	if c.DbPath == "" {
+		errs = append(errs, errors.New("dbPath must not be empty"))
+	}
+
+	if _, err := c.Log.handlerOptions(); err != nil {
+		errs = append(errs, err)
+	}
+	switch strings.ToLower(c.Tracing.Exporter) {
+	case "", "none", "otlp", "stdout":
+	default:
+		errs = append(errs, fmt.Errorf("tracing: invalid exporter %q, must be otlp, stdout or none", c.Tracing.Exporter))
+	}
+
+	for _, ip := range c.SourceIps {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			errs = append(errs, fmt.Errorf("sourceIps: %q is not an IP address", ip))
+		}
+	}
+	if _, err := ParseSourceStrategy(c.SourceStrategy); err != nil {
+		errs = append(errs, fmt.Errorf("sourceStrategy: %w", err))
+	}
+	if c.SourceCooldown < 0 {
+		errs = append(errs, errors.New("sourceCooldown must not be negative"))
+	}
+
+	if c.Timeouts.Request <= 0 || c.Timeouts.MaxRequest < c.Timeouts.Request {
+		errs = append(errs, errors.New("timeouts: request must be greater than 0 and at most maxRequest"))
+	}
+	for stage, budget := range c.Timeouts.Stages {
+		if _, ok := defaultStageTimeouts[stage]; !ok {
+			errs = append(errs, fmt.Errorf("timeouts: unknown stage %q", stage))
+		} else if budget < 0 {
+			errs = append(errs, fmt.Errorf("timeouts: %s must not be negative", stage))
+		}
+	}
+
+	if c.Resolver.UdpTimeout <= 0 {
+		errs = append(errs, errors.New("resolver: udpTimeout must be greater than 0"))
+	}
+	if c.Resolver.MaxDepth <= 0 {
+		errs = append(errs, errors.New("resolver: maxDepth must be greater than 0"))
+	}
+	if c.Resolver.CacheSize < 0 {
+		errs = append(errs, errors.New("resolver: cacheSize must not be negative"))
+	}
+
+	if c.Rdap.BootstrapUrl == "" {
+		errs = append(errs, errors.New("rdap: bootstrapUrl must not be empty"))
+	} else if err := validateHttpUrl(c.Rdap.BootstrapUrl); err != nil {
+		errs = append(errs, fmt.Errorf("rdap: bootstrapUrl: %w", err))
+	}
+	if c.Rdap.BootstrapRefresh < 0 {
+		errs = append(errs, errors.New("rdap: bootstrapRefresh must not be negative"))
+	}
+	for suffix, server := range c.Rdap.Servers {
+		if suffix == "" || normalizeSuffix(suffix) != suffix {
+			errs = append(errs, fmt.Errorf("rdap: servers: %q must be a lowercase TLD or suffix without dots at either end", suffix))
+		} else if server == "" {
+			errs = append(errs, fmt.Errorf("rdap: servers: %s: URL must not be empty", suffix))
+		} else if err := validateHttpUrl(server); err != nil {
+			errs = append(errs, fmt.Errorf("rdap: servers: %s: %w", suffix, err))
+		}
+	}
+
+	for suffix, host := range c.Whois.Servers {
+		if suffix == "" || normalizeSuffix(suffix) != suffix {
+			errs = append(errs, fmt.Errorf("whois: servers: %q must be a lowercase TLD or suffix without dots at either end", suffix))
+		} else if host == "" || strings.ContainsAny(host, "/: ") {
+			errs = append(errs, fmt.Errorf("whois: servers: %s: %q is not a hostname", suffix, host))
+		}
+	}
+	for host, format := range c.Whois.QueryFormats {
+		if host != strings.ToLower(host) {
+			errs = append(errs, fmt.Errorf("whois: queryFormats: %q must be lowercase", host))
+		} else if !strings.Contains(format, whoisQueryPlaceholder) {
+			errs = append(errs, fmt.Errorf("whois: queryFormats: %s: %q doesn't include %s", host, format, whoisQueryPlaceholder))
+		}
+	}
+	if c.Whois.MaxReferrals < 0 {
+		errs = append(errs, errors.New("whois: maxReferrals must not be negative"))
+	}
+
+	if err := validateHttpUrl(c.Registrars.Url); err != nil {
+		errs = append(errs, fmt.Errorf("registrars: url: %w", err))
+	}
+	if c.Registrars.Refresh < 0 {
+		errs = append(errs, errors.New("registrars: refresh must not be negative"))
+	}
+	for ianaId, override := range c.Registrars.Overrides {
+		if ianaId <= 0 {
+			errs = append(errs, fmt.Errorf("registrars: overrides: %d is not an IANA registrar ID", ianaId))
+			continue
+		}
+		for _, u := range []string{override.RdapUrl, override.Website} {
+			if err := validateHttpUrl(u); err != nil {
+				errs = append(errs, fmt.Errorf("registrars: overrides: %d: %w", ianaId, err))
+			}
+		}
+		if strings.ContainsAny(override.WhoisServer, "/: ") {
+			errs = append(errs, fmt.Errorf("registrars: overrides: %d: %q is not a hostname", ianaId, override.WhoisServer))
+		}
+	}
+
+	for tld := range c.Tlds {
+		if tld == "" || normalizeSuffix(tld) != tld {
+			errs = append(errs, fmt.Errorf("tlds: %q must be a lowercase TLD or suffix without dots at either end", tld))
+		}
+	}
+
+	for suffix := range c.PrivateSuffixes {
+		if suffix == "" || normalizeSuffix(suffix) != suffix {
+			errs = append(errs, fmt.Errorf("privateSuffixes: %q must be a lowercase suffix without dots at either end", suffix))
+		}
+	}
+
+	for host, profile := range c.Upstreams {
+		if profile.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("upstreams: %s: timeout must not be negative", host))
+		}
+		if profile.RateLimit != nil {
+			if err := profile.RateLimit.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("upstreams: %s: rateLimit: %w", host, err))
+			}
+		}
+	}
+	for upstream, limit := range c.RateLimits.Defaults {
+		if _, ok := defaultRateLimits[upstream]; !ok {
+			errs = append(errs, fmt.Errorf("rateLimits: unknown upstream %q, must be rdap, whois, dns or resolver", upstream))
+		} else if err := limit.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rateLimits: %s: %w", upstream, err))
+		}
+	}
+	if c.RateLimits.Backoff < 0 {
+		errs = append(errs, errors.New("rateLimits: backoff must not be negative"))
+	}
+
+	if c.Cache.Size < 0 || c.Cache.Ttl < 0 || c.Cache.StaleWhileRevalidate < 0 {
+		errs = append(errs, errors.New("cache: size, ttl and staleWhileRevalidate must not be negative"))
+	}
+
+	if c.Retention.MaxAge < 0 || c.Retention.MaxEntries < 0 {
+		errs = append(errs, errors.New("retention: maxAge and maxEntries must not be negative"))
+	}
+
+	if c.Watch.Concurrency < 1 {
+		errs = append(errs, errors.New("watch: concurrency must be at least 1"))
+	}
+	if c.Watch.Jitter < 0 || c.Watch.Jitter >= 1 {
+		errs = append(errs, errors.New("watch: jitter must be at least 0 and less than 1"))
+	}
+
+	for _, u := range []string{c.Alerts.WebhookUrl, c.Alerts.SlackWebhookUrl} {
+		if err := validateHttpUrl(u); err != nil {
+			errs = append(errs, fmt.Errorf("alerts: %w", err))
+		}
+	}
+	if c.Alerts.Smtp.Addr != "" && (c.Alerts.Smtp.From == "" || len(c.Alerts.Smtp.To) == 0) {
+		errs = append(errs, errors.New("alerts: smtp from and to are required with addr"))
+	}
+
+	for _, u := range c.Events.WebhookUrls {
+		if err := validateHttpUrl(u); err != nil {
+			errs = append(errs, fmt.Errorf("events: %w", err))
+		}
+	}
+	if len(c.Events.WebhookUrls) > 0 && c.Events.WebhookSecret == "" {
+		errs = append(errs, errors.New("events: webhookSecret is required with webhookUrls"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateHttpUrl accepts empty or absolute http(s) URLs.
+func validateHttpUrl(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", s)
+	}
+	return nil
+}
+
+// upstreamContext bounds one query to host by its profile's timeout, if it has one.
+func upstreamContext(ctx context.Context, host string) (context.Context, context.CancelFunc) {
+	if profile, ok := config.Upstreams[host]; ok && profile.Timeout > 0 {
+		return context.WithTimeout(ctx, profile.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
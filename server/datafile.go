@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dataFileRetry is how soon a failed refresh is tried again, if that's sooner than the usual refresh.
+	dataFileRetry = 15 * time.Minute
+	// dataFileTimeout bounds a download.
+	dataFileTimeout = time.Minute
+	// maxDataFileSize is far more than any of the files will plausibly grow to.
+	maxDataFileSize = 16 << 20
+)
+
+// DataFile is reference data, like IANA's registries, that we keep a copy of. It's downloaded from url and saved
+// to path, so a restart can load it from disk rather than downloading it again, and downloaded again every refresh.
+// Without a url it's only ever read from path, and reread every refresh, so it can be kept up to date offline.
+type DataFile struct {
+	name    string
+	url     string
+	path    string
+	refresh time.Duration
+	// parse takes the file's contents and replaces whatever the owner had loaded from it before
+	parse  func(body []byte) error
+	client *http.Client
+
+	// loading is held while the file is first loaded, so concurrent lookups before it's loaded wait for one download
+	// rather than each starting their own. Once loaded is set lookups don't take it, and refreshes don't either, so
+	// lookups never wait on a refresh.
+	loading sync.Mutex
+	loaded  atomic.Bool
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func NewDataFile(name string, url string, path string, refresh time.Duration, parse func(body []byte) error) *DataFile {
+	return &DataFile{
+		name:    name,
+		url:     url,
+		path:    path,
+		refresh: refresh,
+		parse:   parse,
+		client:  &http.Client{Timeout: dataFileTimeout},
+	}
+}
+
+// LoadFile loads the copy at path, if there is one. A missing or broken copy isn't fatal when there's a url, it's
+// just downloaded instead.
+func (f *DataFile) LoadFile() {
+	if f.path == "" {
+		return
+	}
+
+	f.loading.Lock()
+	defer f.loading.Unlock()
+	if err := f.loadFile(); err != nil && (f.url == "" || !os.IsNotExist(err)) {
+		slog.Warn("failed to load "+f.name, "path", f.path, "err", err)
+	}
+}
+
+func (f *DataFile) loadFile() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(io.LimitReader(file, maxDataFileSize))
+	if err != nil {
+		return err
+	}
+	if err := f.parse(body); err != nil {
+		return err
+	}
+
+	if f.url != "" {
+		f.setLoaded(stat.ModTime().Add(f.refresh))
+	} else {
+		f.setLoaded(time.Now().Add(f.refresh))
+	}
+	slog.Info("loaded "+f.name, "path", f.path)
+	return nil
+}
+
+func (f *DataFile) download(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", f.url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDataFileSize))
+	if err != nil {
+		return err
+	}
+	if err := f.parse(body); err != nil {
+		return err
+	}
+	f.setLoaded(time.Now().Add(f.refresh))
+	slog.Info("downloaded "+f.name, "url", f.url)
+
+	if f.path != "" {
+		if err := writeFileAtomic(f.path, body); err != nil {
+			slog.Warn("failed to save "+f.name, "path", f.path, "err", err)
+		}
+	}
+	return nil
+}
+
+// setLoaded records that the file has been parsed, and when it's next due a refresh.
+func (f *DataFile) setLoaded(next time.Time) {
+	f.mu.Lock()
+	f.next = next
+	f.mu.Unlock()
+	f.loaded.Store(true)
+}
+
+// update downloads the file if there's a url, otherwise rereads it. parse swaps in what it read, so lookups carry on
+// with the old copy until then.
+func (f *DataFile) update(ctx context.Context) error {
+	if f.url != "" {
+		return f.download(ctx)
+	}
+	return f.loadFile()
+}
+
+// writeFileAtomic writes body to path by way of a temporary file, so a crash halfway through doesn't leave a
+// truncated file to be loaded next time.
+func writeFileAtomic(path string, body []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// EnsureLoaded loads the file if it hasn't been loaded yet.
+func (f *DataFile) EnsureLoaded(ctx context.Context) error {
+	if f.loaded.Load() {
+		return nil
+	}
+
+	f.loading.Lock()
+	defer f.loading.Unlock()
+	if f.loaded.Load() {
+		return nil
+	}
+	if err := f.update(ctx); err != nil {
+		return fmt.Errorf("failed to load %s: %w", f.name, err)
+	}
+	return nil
+}
+
+// Run keeps the file up to date until ctx is done. With no refresh it's only loaded, if it wasn't already, so the
+// first lookup doesn't have to wait for it.
+func (f *DataFile) Run(ctx context.Context) {
+	retry := dataFileRetry
+	if f.refresh > 0 {
+		retry = min(retry, f.refresh)
+	}
+
+	for {
+		f.mu.Lock()
+		next := f.next
+		f.mu.Unlock()
+		loaded := f.loaded.Load()
+		if loaded && f.refresh <= 0 {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		updateCtx, cancel := context.WithTimeout(ctx, dataFileTimeout)
+		var err error
+		if loaded {
+			err = f.update(updateCtx)
+		} else {
+			// Lookups may be waiting for this one
+			err = f.EnsureLoaded(updateCtx)
+		}
+		cancel()
+		if err != nil {
+			slog.Error("failed to refresh "+f.name, "url", f.url, "path", f.path, "err", err)
+			// Keep using what we have, and try again sooner than usual
+			f.mu.Lock()
+			f.next = time.Now().Add(retry)
+			f.mu.Unlock()
+		}
+	}
+}
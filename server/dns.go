@@ -6,6 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 	"maps"
 	"math/rand"
 	"net"
@@ -13,24 +16,27 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type DnsRecord struct {
-	Name string `json:"name"`
-	Type string `json:"type"`
-	Data string `json:"data"`
-	Ttl  uint32 `json:"ttl"`
+	Name        string `json:"name"`
+	NameUnicode string `json:"nameUnicode"`
+	Type        string `json:"type"`
+	Data        string `json:"data"`
+	Ttl         uint32 `json:"ttl"`
 }
 
-func GetDnsRecordsFromNs(hostname string, nameservers []string, deep bool) (map[string][]DnsRecord, error) {
+// GetDnsRecordsFromNs resolves nameservers and then asks them about hostname, see GetDnsRecordsFromIp.
+func GetDnsRecordsFromNs(ctx context.Context, hostname string, nameservers []string, deep bool) (map[string][]DnsRecord, []string, error) {
 	ips := make(map[netip.Addr]struct{})
-	res := Resolver{
-		queryCache: map[dnsQuery]dnsMsgWithExpiry{},
-	}
+	res := newResolver(ctx)
 	for _, nameserver := range nameservers {
-		resp, _, err := res.Resolve(context.Background(), nameserver)
+		resolveCtx, cancel := stageContext(ctx, StageDns)
+		resp, _, err := res.Resolve(resolveCtx, nameserver)
+		cancel()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		for _, addr := range resp {
@@ -39,12 +45,15 @@ func GetDnsRecordsFromNs(hostname string, nameservers []string, deep bool) (map[
 	}
 
 	if ips == nil || len(ips) == 0 {
-		return nil, errors.New("failed to get ip for nameservers")
+		return nil, nil, errors.New("failed to get ip for nameservers")
 	}
-	return GetDnsRecordsFromIp(hostname, slices.Collect(maps.Keys(ips)), deep)
+	return GetDnsRecordsFromIp(ctx, hostname, slices.Collect(maps.Keys(ips)), deep)
 }
 
-func GetDnsRecordsFromIp(hostname string, ips []netip.Addr, deep bool) (map[string][]DnsRecord, error) {
+// GetDnsRecordsFromIp asks the servers at ips about hostname, keyed by server. Unless deep is set, only the first
+// server to answer is returned. Servers that run out of time are left out of the map and returned separately so the
+// caller can report a partial result; it's only an error if none of them answered.
+func GetDnsRecordsFromIp(ctx context.Context, hostname string, ips []netip.Addr, deep bool) (map[string][]DnsRecord, []string, error) {
 	c := new(dns.Client)
 
 	if !deep {
@@ -53,22 +62,27 @@ func GetDnsRecordsFromIp(hostname string, ips []netip.Addr, deep bool) (map[stri
 		})
 		for _, ip := range ips {
 			retMap := make(map[string][]DnsRecord)
-			res, err := getDnsRecords(c, hostname, ip)
+			res, err := getDnsRecords(ctx, c, hostname, ip)
 			if err != nil {
 				continue
 			}
 
 			retMap[ip.String()] = res
 
-			return retMap, nil
+			return retMap, nil, nil
 		}
 	}
 
 	retMap := make(map[string][]DnsRecord)
 	errs := make([]error, 0, len(ips))
+	var timedOut []string
 	for _, ip := range ips {
-		res, err := getDnsRecords(c, hostname, ip)
+		res, err := getDnsRecords(ctx, c, hostname, ip)
 		if err != nil {
+			if isTimeout(err) {
+				timedOut = append(timedOut, ip.String())
+				continue
+			}
 			errs = append(errs, err)
 		}
 
@@ -76,28 +90,37 @@ func GetDnsRecordsFromIp(hostname string, ips []netip.Addr, deep bool) (map[stri
 	}
 
 	if len(errs) > 0 {
-		return nil, errors.Join(errs...)
+		return nil, nil, errors.Join(errs...)
+	}
+	if len(retMap) == 0 {
+		return nil, nil, newLookupError(ErrCodeUpstreamTimeout, fmt.Errorf("timed out asking %s", strings.Join(timedOut, ", ")))
 	}
 
-	fmt.Println(retMap)
-	return retMap, nil
+	return retMap, timedOut, nil
 }
 
-func getDnsRecords(client *dns.Client, hostname string, addr netip.Addr) ([]DnsRecord, error) {
+func getDnsRecords(ctx context.Context, client *dns.Client, hostname string, addr netip.Addr) ([]DnsRecord, error) {
 	hostname = strings.TrimSuffix(hostname, ".") + "."
 	server := net.JoinHostPort(addr.String(), "53")
 
+	ctx, cancel := stageContext(ctx, StageDns)
+	defer cancel()
+
+	// Groups the questions to one server under one span
+	ctx, span := tracer.Start(ctx, "getDnsRecords", trace.WithAttributes(semconv.ServerAddress(addr.String()), semconv.DNSQuestionName(hostname)))
+	defer span.End()
+
 	const numQuestions = 8
 	errCh := make(chan error, numQuestions)
 	ansCh := make(chan []dns.RR, numQuestions)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeA, Qclass: dns.ClassINET}, ansCh, errCh)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, ansCh, errCh)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}, ansCh, errCh)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, ansCh, errCh)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeMX, Qclass: dns.ClassINET}, ansCh, errCh)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeSOA, Qclass: dns.ClassINET}, ansCh, errCh)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeDS, Qclass: dns.ClassINET}, ansCh, errCh)
-	go askQuestion(client, server, dns.Question{Name: hostname, Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeA, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeMX, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeSOA, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeDS, Qclass: dns.ClassINET}, ansCh, errCh)
+	go askQuestion(ctx, client, server, dns.Question{Name: hostname, Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET}, ansCh, errCh)
 
 	var errs []error
 	for range numQuestions {
@@ -121,10 +144,11 @@ func getDnsRecords(client *dns.Client, hostname string, addr netip.Addr) ([]DnsR
 				name = "@"
 			}
 			records = append(records, DnsRecord{
-				Name: name,
-				Type: dns.TypeToString[rr.Header().Rrtype],
-				Data: getRecordData(rr),
-				Ttl:  rr.Header().Ttl,
+				Name:        name,
+				NameUnicode: toUnicode(name),
+				Type:        dns.TypeToString[rr.Header().Rrtype],
+				Data:        getRecordData(rr),
+				Ttl:         rr.Header().Ttl,
 			})
 		}
 	}
@@ -174,14 +198,29 @@ func getRecordData(rr dns.RR) string {
 	return rr.String()
 }
 
-func askQuestion(client *dns.Client, server string, question dns.Question, ansCh chan<- []dns.RR, errCh chan<- error) {
+func askQuestion(ctx context.Context, client *dns.Client, server string, question dns.Question, ansCh chan<- []dns.RR, errCh chan<- error) {
 	m := new(dns.Msg)
 	m.SetEdns0(4096, true)
 	m.RecursionDesired = true
 	m.Question = make([]dns.Question, 1)
 	m.Question[0] = question
 
-	resp, _, err := client.Exchange(m, server)
+	host, _, _ := net.SplitHostPort(server)
+	ctx, span := startUpstreamSpan(ctx, upstreamDns, host,
+		semconv.DNSQuestionName(question.Name), attribute.String("dns.question.type", dns.TypeToString[question.Qtype]))
+	err := rateLimiter.Wait(ctx, upstreamDns, host)
+	start := time.Now()
+	var resp *dns.Msg
+	if err == nil {
+		queryCtx, cancel := upstreamContext(ctx, host)
+		resp, _, err = client.ExchangeContext(queryCtx, m, server)
+		cancel()
+	}
+	if resp != nil {
+		span.SetAttributes(attribute.String("dns.response.rcode", dns.RcodeToString[resp.Rcode]))
+	}
+	endSpan(span, err)
+	observeUpstream(upstreamDns, tldOf(question.Name), host, start, err)
 
 	if err != nil {
 		ansCh <- []dns.RR{}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+)
+
+// maxDsReferrals is how many referrals we follow down from the root looking for the zone that holds a domain's DS
+// records. A domain is rarely more than two or three zones deep.
+const maxDsReferrals = 10
+
+// DsRecord is a DS record, whether the parent zone serves it, the registry lists it, the zone asks for it with a CDS
+// record, or we worked it out from a key.
+type DsRecord struct {
+	KeyTag     uint16 `json:"keyTag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digestType"`
+	Digest     string `json:"digest"`
+}
+
+func dsRecordOf(ds *dns.DS) DsRecord {
+	return DsRecord{
+		KeyTag:     ds.KeyTag,
+		Algorithm:  ds.Algorithm,
+		DigestType: ds.DigestType,
+		Digest:     strings.ToUpper(ds.Digest),
+	}
+}
+
+// String is the record's presentation format, like getRecordData gives for DS records.
+func (d DsRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, d.Digest)
+}
+
+// DsKey is a key signing key the zone serves, or one a CDNSKEY record asks the parent to point at.
+type DsKey struct {
+	KeyTag    uint16 `json:"keyTag"`
+	Algorithm uint8  `json:"algorithm"`
+	Flags     uint16 `json:"flags"`
+	// Ds are the SHA-256 and SHA-384 DS records that would point at the key, ready to hand to a registrar.
+	Ds []DsRecord `json:"ds"`
+	// InParent says whether the parent serves a DS record that points at the key.
+	InParent bool `json:"inParent"`
+}
+
+// DsMatch is a DS record and whether it points at a key the zone serves.
+type DsMatch struct {
+	DsRecord
+	MatchesKey bool `json:"matchesKey"`
+}
+
+// DsAutomation is where an automated key rollover stands, going by the CDS and CDNSKEY records a zone publishes for
+// its parent to pick up (RFC 7344), or to have its DS records removed with (RFC 8078).
+type DsAutomation string
+
+const (
+	// dsAutomationNone means the zone publishes no CDS or CDNSKEY records.
+	dsAutomationNone DsAutomation = "none"
+	// dsAutomationInSync means the parent already serves the DS records the zone asks for.
+	dsAutomationInSync DsAutomation = "in-sync"
+	// dsAutomationPending means the zone asks for DS records the parent doesn't serve yet, which it should pick up
+	// the next time it scans.
+	dsAutomationPending DsAutomation = "pending"
+	// dsAutomationDeletePending means the zone asks for its DS records to be removed and the parent still serves
+	// them.
+	dsAutomationDeletePending DsAutomation = "delete-pending"
+	// dsAutomationBroken means the records are ones the parent has to ignore, like ones for keys the zone doesn't
+	// serve, or ones the nameservers disagree on.
+	dsAutomationBroken DsAutomation = "broken"
+)
+
+// DsReport relates the keys a zone serves to the DS records its parent serves and its registry lists for it.
+type DsReport struct {
+	Domain string `json:"domain"`
+	// Keys are the zone's key signing keys.
+	Keys     []DsKey   `json:"keys"`
+	ParentDs []DsMatch `json:"parentDs"`
+	// RdapDs are the DS records the registry's RDAP server lists. They're left out if the lookup didn't list any,
+	// since WHOIS and many RDAP servers don't.
+	RdapDs  []DsMatch `json:"rdapDs,omitempty"`
+	Cds     []DsMatch `json:"cds"`
+	Cdnskey []DsKey   `json:"cdnskey"`
+	// Automation is where a rollover through Cds and Cdnskey stands.
+	Automation DsAutomation `json:"automation"`
+	Issues     []string     `json:"issues"`
+}
+
+// zoneKeys is what the zone's nameservers serve at its apex, deduplicated across them.
+type zoneKeys struct {
+	dnskeys  []*dns.DNSKEY
+	cds      []DsRecord
+	cdnskeys []*dns.DNSKEY
+	// consistent is false if the nameservers disagree on the CDS or CDNSKEY records, which RFC 7344 says the parent
+	// has to ignore.
+	consistent bool
+}
+
+// GetDsReport asks the parent zone for info.Domain's DS records and the delegated nameservers for its keys, and
+// compares them with each other and what the registry listed.
+func GetDsReport(ctx context.Context, info DomainInfo) (DsReport, error) {
+	if len(info.Nameservers) == 0 {
+		return DsReport{}, newLookupError(ErrCodeNotFound, fmt.Errorf("%s has no nameservers", info.Domain))
+	}
+
+	parentDs, err := getParentDs(ctx, info.Domain)
+	if err != nil {
+		return DsReport{}, fmt.Errorf("failed to get DS records from the parent zone: %w", err)
+	}
+
+	zone, issues := getZoneKeys(ctx, info.Domain, info.Nameservers)
+	report := evaluateDs(info.Domain, parentDs, info.DsData, zone)
+	report.Issues = append(issues, report.Issues...)
+	return report, nil
+}
+
+// evaluateDs works out the report from what the parent, the registry and the zone have.
+func evaluateDs(domain string, parentDs []DsRecord, rdapDs []DsRecord, zone zoneKeys) DsReport {
+	report := DsReport{
+		Domain:   domain,
+		Keys:     make([]DsKey, 0),
+		ParentDs: dsMatches(parentDs, zone.dnskeys),
+		Cds:      dsMatches(zone.cds, zone.dnskeys),
+		Cdnskey:  make([]DsKey, 0),
+		Issues:   make([]string, 0),
+	}
+	if len(rdapDs) > 0 {
+		report.RdapDs = dsMatches(rdapDs, zone.dnskeys)
+	}
+	for _, key := range zone.dnskeys {
+		if key.Flags&dns.SEP != 0 {
+			report.Keys = append(report.Keys, dsKeyOf(key, parentDs))
+		}
+	}
+	for _, key := range zone.cdnskeys {
+		report.Cdnskey = append(report.Cdnskey, dsKeyOf(key, parentDs))
+	}
+
+	switch {
+	case len(parentDs) > 0 && len(zone.dnskeys) == 0:
+		report.Issues = append(report.Issues, "the parent has DS records but the nameservers serve no DNSKEY records, so validating resolvers will fail to resolve the domain")
+	case len(parentDs) > 0 && !slices.ContainsFunc(report.ParentDs, func(ds DsMatch) bool { return ds.MatchesKey }):
+		report.Issues = append(report.Issues, "none of the parent's DS records match a key the zone serves, so validating resolvers will fail to resolve the domain")
+	case len(parentDs) > 0:
+		for _, ds := range report.ParentDs {
+			if !ds.MatchesKey {
+				report.Issues = append(report.Issues, fmt.Sprintf("the parent's DS record %s doesn't match any key the zone serves", ds.DsRecord))
+			}
+		}
+	case len(report.Keys) > 0:
+		report.Issues = append(report.Issues, "the zone is signed but the parent has no DS records, so it can't be validated")
+	}
+	for _, ds := range parentDs {
+		if ds.DigestType == dns.SHA1 {
+			report.Issues = append(report.Issues, fmt.Sprintf("the parent's DS record %s uses a SHA-1 digest, which RFC 8624 says not to publish", ds))
+		}
+	}
+	if len(rdapDs) > 0 && !sameDsRecords(parentDs, rdapDs) {
+		report.Issues = append(report.Issues, fmt.Sprintf("the registry lists DS records %s but the parent zone serves %s",
+			formatDsRecords(rdapDs), formatDsRecords(parentDs)))
+	}
+
+	report.Automation = report.automation(parentDs, zone)
+	return report
+}
+
+// automation works out where a rollover through CDS and CDNSKEY records stands, adding an issue for anything that
+// makes it broken.
+func (report *DsReport) automation(parentDs []DsRecord, zone zoneKeys) DsAutomation {
+	if len(zone.cds) == 0 && len(zone.cdnskeys) == 0 {
+		return dsAutomationNone
+	}
+
+	// RFC 8078's delete request is a CDS of "0 0 0 00" and a CDNSKEY of "0 3 0 AA==", and can't be mixed with keys
+	deletes := 0
+	for _, ds := range zone.cds {
+		if ds.Algorithm == 0 {
+			deletes++
+		}
+	}
+	for _, key := range zone.cdnskeys {
+		if key.Algorithm == 0 {
+			deletes++
+		}
+	}
+	if deletes > 0 {
+		switch {
+		case deletes != len(zone.cds)+len(zone.cdnskeys):
+			report.Issues = append(report.Issues, "the zone mixes a request to delete its DS records with CDS or CDNSKEY records for keys")
+			return dsAutomationBroken
+		case !zone.consistent:
+			return dsAutomationBroken
+		case len(parentDs) > 0:
+			return dsAutomationDeletePending
+		default:
+			return dsAutomationInSync
+		}
+	}
+
+	broken := !zone.consistent
+	for _, ds := range report.Cds {
+		if !ds.MatchesKey {
+			report.Issues = append(report.Issues, fmt.Sprintf("the CDS record %s doesn't match any key the zone serves", ds.DsRecord))
+			broken = true
+		}
+	}
+	for _, key := range zone.cdnskeys {
+		if !slices.ContainsFunc(zone.dnskeys, func(k *dns.DNSKEY) bool { return sameKey(k, key) }) {
+			report.Issues = append(report.Issues, fmt.Sprintf("the CDNSKEY record for key %d isn't a key the zone serves", key.KeyTag()))
+			broken = true
+		}
+	}
+	if len(zone.cds) > 0 && len(zone.cdnskeys) > 0 {
+		var fromCds, fromCdnskey []uint16
+		for _, ds := range zone.cds {
+			fromCds = append(fromCds, ds.KeyTag)
+		}
+		for _, key := range zone.cdnskeys {
+			fromCdnskey = append(fromCdnskey, key.KeyTag())
+		}
+		slices.Sort(fromCds)
+		slices.Sort(fromCdnskey)
+		if !slices.Equal(slices.Compact(fromCds), slices.Compact(fromCdnskey)) {
+			report.Issues = append(report.Issues, "the CDS and CDNSKEY records point at different keys")
+			broken = true
+		}
+	}
+	if broken {
+		return dsAutomationBroken
+	}
+
+	// The parent builds its DS records from CDS records if there are any, and from CDNSKEY records with a digest
+	// type of its choosing if not
+	inSync := false
+	if len(zone.cds) > 0 {
+		inSync = sameDsRecords(parentDs, zone.cds)
+	} else {
+		inSync = !slices.ContainsFunc(report.Cdnskey, func(key DsKey) bool { return !key.InParent }) &&
+			!slices.ContainsFunc(parentDs, func(ds DsRecord) bool {
+				return !slices.ContainsFunc(zone.cdnskeys, func(key *dns.DNSKEY) bool { return keyHasDs(key, ds) })
+			})
+	}
+	if inSync {
+		return dsAutomationInSync
+	}
+	return dsAutomationPending
+}
+
+// dsKeyOf describes key, with the DS records that would point at it.
+func dsKeyOf(key *dns.DNSKEY, parentDs []DsRecord) DsKey {
+	dsKey := DsKey{
+		KeyTag:    key.KeyTag(),
+		Algorithm: key.Algorithm,
+		Flags:     key.Flags,
+		Ds:        make([]DsRecord, 0, 2),
+		InParent:  slices.ContainsFunc(parentDs, func(ds DsRecord) bool { return keyHasDs(key, ds) }),
+	}
+	for _, digestType := range []uint8{dns.SHA256, dns.SHA384} {
+		if ds := key.ToDS(digestType); ds != nil {
+			dsKey.Ds = append(dsKey.Ds, dsRecordOf(ds))
+		}
+	}
+	return dsKey
+}
+
+func dsMatches(records []DsRecord, keys []*dns.DNSKEY) []DsMatch {
+	matches := make([]DsMatch, 0, len(records))
+	for _, ds := range records {
+		matches = append(matches, DsMatch{
+			DsRecord:   ds,
+			MatchesKey: slices.ContainsFunc(keys, func(key *dns.DNSKEY) bool { return keyHasDs(key, ds) }),
+		})
+	}
+	return matches
+}
+
+// keyHasDs is whether ds points at key. Digest types we can't compute, like GOST, never match.
+func keyHasDs(key *dns.DNSKEY, ds DsRecord) bool {
+	if key.Algorithm != ds.Algorithm || key.KeyTag() != ds.KeyTag {
+		return false
+	}
+	computed := key.ToDS(ds.DigestType)
+	return computed != nil && strings.EqualFold(computed.Digest, ds.Digest)
+}
+
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Flags == b.Flags && a.Protocol == b.Protocol && a.Algorithm == b.Algorithm && a.PublicKey == b.PublicKey
+}
+
+func compareDsRecords(a, b DsRecord) int {
+	return cmp.Or(
+		cmp.Compare(a.KeyTag, b.KeyTag),
+		cmp.Compare(a.Algorithm, b.Algorithm),
+		cmp.Compare(a.DigestType, b.DigestType),
+		cmp.Compare(a.Digest, b.Digest),
+	)
+}
+
+// sameDsRecords compares two lists of DS records as sets.
+func sameDsRecords(a, b []DsRecord) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.SortFunc(a, compareDsRecords)
+	slices.SortFunc(b, compareDsRecords)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+func formatDsRecords(records []DsRecord) string {
+	if len(records) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(records))
+	for i, ds := range records {
+		parts[i] = ds.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// getParentDs asks the parent zone's nameservers for domain's DS records, following referrals down from the root. A
+// recursive resolver would do, but could answer from a cache that's behind the parent.
+func getParentDs(ctx context.Context, domain string) ([]DsRecord, error) {
+	res := newResolver(ctx)
+	client := new(dns.Client)
+	servers := slices.Clone(rootServersV4)
+	for range maxDsReferrals {
+		resp, err := queryFirst(ctx, client, domain, dns.TypeDS, servers)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.Rcode == dns.RcodeNameError:
+			return nil, newLookupError(ErrCodeNotFound, fmt.Errorf("%s doesn't exist in its parent zone", domain))
+		case resp.Rcode != dns.RcodeSuccess:
+			return nil, fmt.Errorf("the parent zone answered %s", dns.RcodeToString[resp.Rcode])
+		case resp.Authoritative:
+			records := make([]DsRecord, 0)
+			for _, rr := range resp.Answer {
+				if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, dns.Fqdn(domain)) {
+					records = append(records, dsRecordOf(ds))
+				}
+			}
+			return records, nil
+		}
+
+		servers, err = followReferral(ctx, res, domain, resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("gave up after %d referrals", maxDsReferrals)
+}
+
+// followReferral finds the addresses of the nameservers resp refers us to, from its glue if it has any.
+func followReferral(ctx context.Context, res *Resolver, domain string, resp *dns.Msg) ([]netip.Addr, error) {
+	var names []string
+	for _, rr := range resp.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			// The parent is authoritative for a DS record, so a referral to the domain itself is a broken parent
+			if strings.EqualFold(ns.Hdr.Name, dns.Fqdn(domain)) {
+				return nil, fmt.Errorf("the parent zone referred us to %s's own nameservers", domain)
+			}
+			names = append(names, strings.ToLower(ns.Ns))
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("the parent zone answered without a referral")
+	}
+
+	var addrs []netip.Addr
+	for _, rr := range resp.Extra {
+		var addr netip.Addr
+		switch glue := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(glue.A.To4())
+		case *dns.AAAA:
+			if !res.NoIPv6 {
+				addr, _ = netip.AddrFromSlice(glue.AAAA)
+			}
+		}
+		if addr.IsValid() && slices.Contains(names, strings.ToLower(rr.Header().Name)) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	var errs []error
+	for _, name := range names {
+		resolveCtx, cancel := stageContext(ctx, StageDns)
+		resolved, _, err := res.Resolve(resolveCtx, name)
+		cancel()
+		if err == nil && len(resolved) > 0 {
+			return resolved, nil
+		}
+		errs = append(errs, fmt.Errorf("%s doesn't resolve: %w", name, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// getZoneKeys asks every address of every nameserver for the zone's DNSKEY, CDS and CDNSKEY records. Nameservers
+// that don't answer are reported as issues, and the rest are used.
+func getZoneKeys(ctx context.Context, domain string, nameservers []string) (zoneKeys, []string) {
+	res := newResolver(ctx)
+	client := new(dns.Client)
+	zone := zoneKeys{consistent: true}
+	var issues []string
+	// What each server published, so servers that disagree can be named
+	cdsSets := make(map[string][]string)
+	cdnskeySets := make(map[string][]string)
+
+	for _, nameserver := range nameservers {
+		nameserver = normalizeNameserver(nameserver)
+
+		resolveCtx, cancel := stageContext(ctx, StageDns)
+		addrs, _, err := res.Resolve(resolveCtx, nameserver)
+		cancel()
+		if err != nil {
+			issues = append(issues, fmt.Sprintf("%s doesn't resolve: %s", nameserver, err))
+			continue
+		}
+
+		for _, addr := range addrs {
+			server := fmt.Sprintf("%s (%s)", nameserver, addr)
+			var cds, cdnskeys []string
+			var err error
+			for _, qtype := range []uint16{dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY} {
+				var resp *dns.Msg
+				resp, err = queryServer(ctx, client, domain, qtype, addr)
+				if err == nil && !resp.Authoritative {
+					err = errLameDelegation
+				} else if err == nil && resp.Rcode != dns.RcodeSuccess {
+					err = fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+				}
+				if err != nil {
+					break
+				}
+
+				for _, rr := range resp.Answer {
+					switch rr := rr.(type) {
+					case *dns.DNSKEY:
+						if !slices.ContainsFunc(zone.dnskeys, func(k *dns.DNSKEY) bool { return sameKey(k, rr) }) {
+							zone.dnskeys = append(zone.dnskeys, rr)
+						}
+					case *dns.CDS:
+						ds := dsRecordOf(&rr.DS)
+						cds = append(cds, ds.String())
+						if !slices.Contains(zone.cds, ds) {
+							zone.cds = append(zone.cds, ds)
+						}
+					case *dns.CDNSKEY:
+						key := &rr.DNSKEY
+						cdnskeys = append(cdnskeys, fmt.Sprintf("%d %d %d %s", key.Flags, key.Protocol, key.Algorithm, key.PublicKey))
+						if !slices.ContainsFunc(zone.cdnskeys, func(k *dns.DNSKEY) bool { return sameKey(k, key) }) {
+							zone.cdnskeys = append(zone.cdnskeys, key)
+						}
+					}
+				}
+			}
+			if err != nil {
+				issues = append(issues, fmt.Sprintf("%s: %s", server, err))
+				continue
+			}
+
+			slices.Sort(cds)
+			slices.Sort(cdnskeys)
+			cdsSets[strings.Join(cds, ", ")] = append(cdsSets[strings.Join(cds, ", ")], server)
+			cdnskeySets[strings.Join(cdnskeys, ", ")] = append(cdnskeySets[strings.Join(cdnskeys, ", ")], server)
+		}
+	}
+
+	for _, sets := range []struct {
+		rrtype string
+		sets   map[string][]string
+	}{{"CDS", cdsSets}, {"CDNSKEY", cdnskeySets}} {
+		if len(sets.sets) <= 1 {
+			continue
+		}
+		zone.consistent = false
+		var parts []string
+		for _, records := range slices.Sorted(maps.Keys(sets.sets)) {
+			if records == "" {
+				records = "none"
+			}
+			parts = append(parts, fmt.Sprintf("%s from %s", records, strings.Join(sets.sets[records], ", ")))
+		}
+		issues = append(issues, fmt.Sprintf("nameservers disagree on the %s records: %s", sets.rrtype, strings.Join(parts, "; ")))
+	}
+	return zone, issues
+}
+
+// queryFirst asks servers in turn until one answers.
+func queryFirst(ctx context.Context, client *dns.Client, name string, qtype uint16, servers []netip.Addr) (*dns.Msg, error) {
+	var errs []error
+	for _, addr := range servers {
+		resp, err := queryServer(ctx, client, name, qtype, addr)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// queryServer asks the nameserver at addr about name without recursion, with the DO bit set so it answers with
+// DNSSEC records. Answers too big for UDP are asked again over TCP, which key sets often are.
+func queryServer(ctx context.Context, client *dns.Client, name string, qtype uint16, addr netip.Addr) (*dns.Msg, error) {
+	ctx, cancel := stageContext(ctx, StageDns)
+	defer cancel()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, true)
+	m.RecursionDesired = false
+
+	host := addr.String()
+	ctx, span := startUpstreamSpan(ctx, upstreamDns, host,
+		semconv.DNSQuestionName(m.Question[0].Name), attribute.String("dns.question.type", dns.TypeToString[qtype]))
+	err := rateLimiter.Wait(ctx, upstreamDns, host)
+	start := time.Now()
+	var resp *dns.Msg
+	if err == nil {
+		queryCtx, cancel := upstreamContext(ctx, host)
+		server := net.JoinHostPort(host, "53")
+		resp, _, err = client.ExchangeContext(queryCtx, m, server)
+		if err == nil && resp.Truncated {
+			tcpClient := &dns.Client{Net: "tcp", Timeout: client.Timeout}
+			resp, _, err = tcpClient.ExchangeContext(queryCtx, m, server)
+		}
+		cancel()
+	}
+	if resp != nil {
+		span.SetAttributes(attribute.String("dns.response.rcode", dns.RcodeToString[resp.Rcode]))
+	}
+	endSpan(span, err)
+	observeUpstream(upstreamDns, tldOf(name), host, start, err)
+	return resp, err
+}
+
+func dsInfo(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	infoReq, err := parseInfoRequest(req)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), infoReq.Timeout)
+	defer cancel()
+
+	cached, err := lookupInfo(ctx, infoReq)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	report, err := GetDsReport(ctx, cached.Info)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
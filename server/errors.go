@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/domainr/whois"
+	whoisparser "github.com/likexian/whois-parser"
+	"github.com/openrdap/rdap"
+)
+
+// ErrorCode is a stable, machine-readable identifier for a class of failure. Clients should switch on these rather
+// than on the human-readable messages, which are free to change.
+type ErrorCode string
+
+const (
+	ErrCodeInvalidInput    ErrorCode = "invalid_input"
+	ErrCodeNotFound        ErrorCode = "not_found"
+	ErrCodeUpstreamTimeout ErrorCode = "upstream_timeout"
+	ErrCodeRateLimited     ErrorCode = "rate_limited"
+	ErrCodeParseFailure    ErrorCode = "parse_failure"
+	ErrCodeInternal        ErrorCode = "internal"
+)
+
+// HttpStatus returns the HTTP status code that a response carrying this error code should use.
+func (c ErrorCode) HttpStatus() int {
+	switch c {
+	case ErrCodeInvalidInput:
+		return http.StatusBadRequest
+	case ErrCodeNotFound:
+		return http.StatusNotFound
+	case ErrCodeUpstreamTimeout:
+		return http.StatusGatewayTimeout
+	case ErrCodeRateLimited:
+		return http.StatusTooManyRequests
+	case ErrCodeParseFailure:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// LookupError attaches an ErrorCode to an error so that it survives being joined with context messages on its way
+// back up to the HTTP handlers.
+type LookupError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *LookupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
+func newLookupError(code ErrorCode, errs ...error) error {
+	return &LookupError{Code: code, Err: errors.Join(errs...)}
+}
+
+func invalidInput(errs ...error) error {
+	return newLookupError(ErrCodeInvalidInput, errs...)
+}
+
+func parseFailure(errs ...error) error {
+	return newLookupError(ErrCodeParseFailure, errs...)
+}
+
+// withFallbackCode joins errs and tags them with code, unless they already classify as something more specific than
+// ErrCodeInternal (e.g. a parser reporting that the domain doesn't exist).
+func withFallbackCode(code ErrorCode, errs ...error) error {
+	err := errors.Join(errs...)
+	if ErrorCodeOf(err) != ErrCodeInternal {
+		return err
+	}
+
+	return &LookupError{Code: code, Err: err}
+}
+
+// ErrorCodeOf classifies err. Explicitly tagged LookupErrors win; otherwise the well-known sentinel errors from the
+// RDAP, WHOIS and networking libraries are recognised, and anything else is ErrCodeInternal.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+
+	var lookupErr *LookupError
+	if errors.As(err, &lookupErr) {
+		return lookupErr.Code
+	}
+
+	var rdapErr *rdap.ClientError
+	if errors.As(err, &rdapErr) {
+		switch rdapErr.Type {
+		case rdap.ObjectDoesNotExist:
+			return ErrCodeNotFound
+		case rdap.InputError, rdap.BootstrapNoMatch:
+			return ErrCodeInvalidInput
+		case rdap.WrongResponseType:
+			return ErrCodeParseFailure
+		}
+	}
+
+	switch {
+	case errors.Is(err, whoisparser.ErrNotFoundDomain),
+		errors.Is(err, whoisparser.ErrReservedDomain),
+		errors.Is(err, whoisparser.ErrPremiumDomain),
+		errors.Is(err, whoisparser.ErrBlockedDomain),
+		errors.Is(err, ErrAuthoritativeNoResponses):
+		return ErrCodeNotFound
+	case errors.Is(err, whoisparser.ErrDomainLimitExceed):
+		return ErrCodeRateLimited
+	case errors.Is(err, whoisparser.ErrDomainDataInvalid):
+		return ErrCodeParseFailure
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrCodeUpstreamTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrCodeUpstreamTimeout
+	}
+
+	// FetchError doesn't implement Unwrap, so look inside it by hand
+	var fetchErr *whois.FetchError
+	if errors.As(err, &fetchErr) && fetchErr.Err != nil {
+		return ErrorCodeOf(fetchErr.Err)
+	}
+
+	return ErrCodeInternal
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var eventDeliveriesBucket = []byte("event-deliveries")
+
+const (
+	// maxDeliveryAttempts is how many times an event is sent to a webhook before giving up on it.
+	maxDeliveryAttempts = 8
+	// Retries back off exponentially from deliveryBackoff, up to maxDeliveryBackoff between attempts.
+	deliveryBackoff    = 5 * time.Second
+	maxDeliveryBackoff = 10 * time.Minute
+	deliveryTimeout    = 10 * time.Second
+)
+
+type EventType string
+
+const (
+	// eventInfoChanged is a DomainInfo field changing, like the nameservers, statuses or registrar.
+	eventInfoChanged EventType = "info.changed"
+	// eventDnsChanged is one RRset on one server changing.
+	eventDnsChanged EventType = "dns.changed"
+)
+
+// ChangeEvent is one change the watchlist checks detected. Info events have Field set, and DNS events say which
+// RRset changed with Hostname, Server, Name and RRType. Before and After are the whole field or RRset, and Added
+// and Removed are the items that came and went.
+type ChangeEvent struct {
+	Id      string    `json:"id"`
+	Type    EventType `json:"type"`
+	EntryId string    `json:"entryId"`
+	Domain  string    `json:"domain"`
+	Time    time.Time `json:"time"`
+
+	Field string `json:"field,omitempty"`
+
+	Hostname string `json:"hostname,omitempty"`
+	Server   string `json:"server,omitempty"`
+	Name     string `json:"name,omitempty"`
+	RRType   string `json:"rrtype,omitempty"`
+
+	Before  any `json:"before"`
+	After   any `json:"after"`
+	Added   any `json:"added,omitempty"`
+	Removed any `json:"removed,omitempty"`
+}
+
+type DeliveryState string
+
+const (
+	deliveryPending   DeliveryState = "pending"
+	deliveryDelivered DeliveryState = "delivered"
+	deliveryFailed    DeliveryState = "failed"
+)
+
+type DeliveryAttempt struct {
+	Time   time.Time `json:"time"`
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Delivery is one event being sent to one webhook, and how that's gone so far.
+type Delivery struct {
+	Id          string            `json:"id"`
+	Url         string            `json:"url"`
+	Created     time.Time         `json:"created"`
+	State       DeliveryState     `json:"state"`
+	NextAttempt *time.Time        `json:"nextAttempt,omitempty"`
+	Attempts    []DeliveryAttempt `json:"attempts"`
+	Event       ChangeEvent       `json:"event"`
+}
+
+func (d Delivery) key() []byte {
+	return append(timeKey(d.Created), d.Id...)
+}
+
+func (s *Store) PutDelivery(d Delivery) error {
+	return s.putSeriesKey(eventDeliveriesBucket, d.Event.EntryId, d.key(), d)
+}
+
+func (s *Store) Deliveries(entryId string, before time.Time, limit int) ([]Delivery, error) {
+	return listSeries[Delivery](s, eventDeliveriesBucket, entryId, before, limit)
+}
+
+// isPendingDelivery reports whether v is a delivery that's still being retried, which retention mustn't delete.
+func isPendingDelivery(v []byte) bool {
+	var d struct {
+		State DeliveryState `json:"state"`
+	}
+	return json.Unmarshal(v, &d) == nil && d.State == deliveryPending
+}
+
+// pendingDeliveries finds the deliveries that were still being retried when the server last stopped.
+func (s *Store) pendingDeliveries() ([]Delivery, error) {
+	var pending []Delivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventDeliveriesBucket).ForEachBucket(func(name []byte) error {
+			return tx.Bucket(eventDeliveriesBucket).Bucket(name).ForEach(func(k, v []byte) error {
+				var d Delivery
+				if err := json.Unmarshal(v, &d); err != nil {
+					return err
+				}
+				if d.State == deliveryPending {
+					pending = append(pending, d)
+				}
+				return nil
+			})
+		})
+	})
+	return pending, err
+}
+
+// Dispatcher turns the changes in watchlist runs into ChangeEvents and posts them to every webhook, retrying with
+// exponential backoff until they're accepted. It's registered with the Scheduler with OnRun.
+//
+// Each request is signed so receivers can check it came from us: the X-Signature header is "sha256=" followed by
+// the hex HMAC-SHA256, keyed with the shared secret, of the X-Timestamp header, a ".", and the body.
+type Dispatcher struct {
+	store  *Store
+	urls   []string
+	secret []byte
+	client *http.Client
+	ctx    context.Context
+}
+
+func NewDispatcher(ctx context.Context, store *Store, urls []string, secret string) *Dispatcher {
+	return &Dispatcher{
+		store:  store,
+		urls:   urls,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: deliveryTimeout},
+		ctx:    ctx,
+	}
+}
+
+// dispatcherFromConfig sets up a Dispatcher for the webhooks in c. It returns nil if there aren't any.
+func dispatcherFromConfig(ctx context.Context, store *Store, c EventConfig) *Dispatcher {
+	if len(c.WebhookUrls) == 0 {
+		return nil
+	}
+
+	return NewDispatcher(ctx, store, c.WebhookUrls, c.WebhookSecret)
+}
+
+// Resume picks the deliveries that were pending when the server stopped back up.
+func (d *Dispatcher) Resume() error {
+	pending, err := d.store.pendingDeliveries()
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range pending {
+		d.start(delivery)
+	}
+	return nil
+}
+
+func (d *Dispatcher) observe(ctx context.Context, entry WatchEntry, run WatchRun) {
+	events, err := changeEvents(d.store, entry, run)
+	if err != nil {
+		loggerFrom(ctx).Error("failed to build change events", "domain", entry.Domain, "err", err)
+	}
+
+	for _, event := range events {
+		for _, url := range d.urls {
+			delivery := Delivery{
+				Id:       newWatchId(),
+				Url:      url,
+				Created:  time.Now(),
+				State:    deliveryPending,
+				Attempts: make([]DeliveryAttempt, 0),
+				Event:    event,
+			}
+			if err := d.store.PutDelivery(delivery); err != nil {
+				loggerFrom(ctx).Error("failed to record delivery", "eventId", event.Id, "url", url, "err", err)
+			}
+			d.start(delivery)
+		}
+	}
+}
+
+func (d *Dispatcher) start(delivery Delivery) {
+	go d.deliver(delivery)
+}
+
+func (d *Dispatcher) deliver(delivery Delivery) {
+	logger := slog.With("eventId", delivery.Event.Id, "deliveryId", delivery.Id, "url", delivery.Url)
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		logger.Error("failed to encode event", "err", err)
+		return
+	}
+
+	for delivery.State == deliveryPending {
+		if delivery.NextAttempt != nil {
+			select {
+			case <-time.After(time.Until(*delivery.NextAttempt)):
+			case <-d.ctx.Done():
+				// Left pending, so Resume picks it up next time
+				return
+			}
+		}
+
+		attempt, retry := d.attempt(delivery, body)
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		delivery.NextAttempt = nil
+		switch {
+		case attempt.Error == "":
+			delivery.State = deliveryDelivered
+		case !retry || len(delivery.Attempts) >= maxDeliveryAttempts:
+			delivery.State = deliveryFailed
+		default:
+			next := attempt.Time.Add(deliveryBackoffFor(len(delivery.Attempts)))
+			delivery.NextAttempt = &next
+		}
+
+		if attempt.Error != "" {
+			logger.Warn("event delivery failed", "attempt", len(delivery.Attempts), "state", delivery.State, "err", attempt.Error)
+		}
+		if err := d.store.PutDelivery(delivery); err != nil {
+			logger.Error("failed to record delivery", "err", err)
+		}
+	}
+}
+
+// deliveryBackoffFor is how long to wait after the given number of failed attempts, with up to 10% jitter so a
+// webhook that comes back isn't hit by every retry at once.
+func deliveryBackoffFor(attempts int) time.Duration {
+	backoff := min(deliveryBackoff<<(attempts-1), maxDeliveryBackoff)
+	return backoff + time.Duration(rand.Int63n(int64(backoff/10)+1))
+}
+
+// attempt posts the event once. Client errors other than 408 and 429 won't go away by retrying, so they aren't.
+func (d *Dispatcher) attempt(delivery Delivery, body []byte) (DeliveryAttempt, bool) {
+	attempt := DeliveryAttempt{Time: time.Now()}
+
+	ctx, cancel := context.WithTimeout(d.ctx, deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	timestamp := strconv.FormatInt(attempt.Time.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", delivery.Event.Id)
+	req.Header.Set("X-Event-Type", string(delivery.Event.Type))
+	req.Header.Set("X-Delivery-Id", delivery.Id)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", "sha256="+d.sign(timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, true
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.Status = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return attempt, false
+	}
+
+	attempt.Error = resp.Status
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return attempt, retry
+}
+
+func (d *Dispatcher) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// changeEvents builds an event for each info field and DNS RRset that changed in run.
+func changeEvents(store *Store, entry WatchEntry, run WatchRun) ([]ChangeEvent, error) {
+	var events []ChangeEvent
+	newEvent := func(eventType EventType) ChangeEvent {
+		return ChangeEvent{Id: newWatchId(), Type: eventType, EntryId: entry.Id, Domain: entry.Domain, Time: run.Time}
+	}
+
+	for _, result := range run.Results {
+		for _, change := range result.Changes {
+			event := newEvent(eventInfoChanged)
+			event.Field = change.Field
+			event.Before, event.After = change.Before, change.After
+			if len(change.Added) > 0 {
+				event.Added = change.Added
+			}
+			if len(change.Removed) > 0 {
+				event.Removed = change.Removed
+			}
+			events = append(events, event)
+		}
+
+		if len(result.RecordChanges) == 0 {
+			continue
+		}
+
+		// The changes only have the records that came and went, the RRsets they belong to are in the snapshots
+		snapshots, err := store.DnsHistory(result.Hostname, run.Time, 2)
+		if err != nil {
+			return events, err
+		}
+		if len(snapshots) < 2 {
+			continue
+		}
+		after, before := snapshots[0].Records, snapshots[1].Records
+
+		type rrset struct{ server, name, rrtype string }
+		changed := make(map[rrset][]RecordChange)
+		for _, change := range result.RecordChanges {
+			set := rrset{change.Server, change.Record.Name, change.Record.Type}
+			changed[set] = append(changed[set], change)
+		}
+
+		sets := slices.SortedFunc(maps.Keys(changed), func(a, b rrset) int {
+			return cmp.Or(cmp.Compare(a.server, b.server), cmp.Compare(a.name, b.name), cmp.Compare(a.rrtype, b.rrtype))
+		})
+		for _, set := range sets {
+			inSet := func(record DnsRecord) bool { return record.Name == set.name && record.Type == set.rrtype }
+
+			event := newEvent(eventDnsChanged)
+			event.Hostname, event.Server, event.Name, event.RRType = result.Hostname, set.server, set.name, set.rrtype
+			beforeSet, afterSet := filterRecords(before[set.server], inSet), filterRecords(after[set.server], inSet)
+			event.Before, event.After = beforeSet, afterSet
+
+			var added, removed []DnsRecord
+			for _, change := range changed[set] {
+				if change.Change == "added" {
+					added = append(added, change.Record)
+				} else {
+					removed = append(removed, change.Record)
+				}
+			}
+			if len(added) > 0 {
+				event.Added = added
+			}
+			if len(removed) > 0 {
+				event.Removed = removed
+			}
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+func filterRecords(records []DnsRecord, keep func(DnsRecord) bool) []DnsRecord {
+	filtered := make([]DnsRecord, 0)
+	for _, record := range records {
+		if keep(record) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+func listDeliveries(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	id := mux.Vars(req)["id"]
+	if _, err := store.GetWatch(id); err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	limit, err := parseLimitParam(req.URL.Query().Get("limit"))
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	deliveries, err := store.Deliveries(id, time.Now(), limit)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(deliveries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	infoHistoryBucket = []byte("info-history")
+	dnsHistoryBucket  = []byte("dns-history")
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+type InfoSnapshot struct {
+	Time time.Time  `json:"time"`
+	Info DomainInfo `json:"info"`
+}
+
+// DnsSnapshot is one /dns lookup of a hostname, keyed by the server that answered.
+type DnsSnapshot struct {
+	Time    time.Time              `json:"time"`
+	Records map[string][]DnsRecord `json:"records"`
+}
+
+type HistoryResp struct {
+	Domain string         `json:"domain"`
+	Info   []InfoSnapshot `json:"info"`
+	Dns    []DnsSnapshot  `json:"dns"`
+}
+
+// FieldChange is a DomainInfo field that differs between two snapshots. List fields also say which items came and
+// went.
+type FieldChange struct {
+	Field   string   `json:"field"`
+	Before  any      `json:"before"`
+	After   any      `json:"after"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// RecordChange is a record that one server started or stopped returning between two snapshots.
+type RecordChange struct {
+	Server string    `json:"server"`
+	Change string    `json:"change"`
+	Record DnsRecord `json:"record"`
+}
+
+type InfoDiff struct {
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// DnsDiff compares the records of the servers both snapshots asked. Servers only one of them asked are listed
+// separately, since a missing server says nothing about whether its records changed.
+type DnsDiff struct {
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	Changes        []RecordChange `json:"changes"`
+	ServersAdded   []string       `json:"serversAdded,omitempty"`
+	ServersRemoved []string       `json:"serversRemoved,omitempty"`
+}
+
+type DiffResp struct {
+	Domain string    `json:"domain"`
+	Info   *InfoDiff `json:"info,omitempty"`
+	Dns    *DnsDiff  `json:"dns,omitempty"`
+}
+
+// RecordInfo stores a snapshot of info. Partial results aren't recorded since the missing fields would show up as
+// changes, and neither are the raw upstream responses.
+func (s *Store) RecordInfo(info DomainInfo, at time.Time) error {
+	if len(info.TimedOut) > 0 {
+		return nil
+	}
+
+	info.Raw = nil
+	return s.putSeries(infoHistoryBucket, info.Domain, at, InfoSnapshot{Time: at, Info: info})
+}
+
+func (s *Store) RecordDns(hostname string, records map[string][]DnsRecord, at time.Time) error {
+	return s.putSeries(dnsHistoryBucket, hostname, at, DnsSnapshot{Time: at, Records: records})
+}
+
+func (s *Store) InfoHistory(domain string, before time.Time, limit int) ([]InfoSnapshot, error) {
+	return listSeries[InfoSnapshot](s, infoHistoryBucket, domain, before, limit)
+}
+
+// InfoHistorySince lists the snapshots of domain taken after since, and the one that was current at since, newest
+// first.
+func (s *Store) InfoHistorySince(domain string, since time.Time, before time.Time) ([]InfoSnapshot, error) {
+	return listSeriesSince[InfoSnapshot](s, infoHistoryBucket, domain, since, before)
+}
+
+func (s *Store) DnsHistory(hostname string, before time.Time, limit int) ([]DnsSnapshot, error) {
+	return listSeries[DnsSnapshot](s, dnsHistoryBucket, hostname, before, limit)
+}
+
+// diffInfo compares the fields of two DomainInfos that describe the domain itself, ignoring where they came from.
+func diffInfo(before DomainInfo, after DomainInfo) []FieldChange {
+	changes := make([]FieldChange, 0)
+
+	diffList := func(field string, a, b []string, normalize func(string) string) {
+		if sameNormalized(normalize)(a, b) {
+			return
+		}
+		setA := make(map[string]struct{})
+		for _, item := range a {
+			setA[normalize(item)] = struct{}{}
+		}
+		setB := make(map[string]struct{})
+		for _, item := range b {
+			setB[normalize(item)] = struct{}{}
+		}
+
+		change := FieldChange{Field: field, Before: a, After: b}
+		for item := range setB {
+			if _, ok := setA[item]; !ok {
+				change.Added = append(change.Added, item)
+			}
+		}
+		for item := range setA {
+			if _, ok := setB[item]; !ok {
+				change.Removed = append(change.Removed, item)
+			}
+		}
+		slices.Sort(change.Added)
+		slices.Sort(change.Removed)
+		changes = append(changes, change)
+	}
+	diffValue := func(field string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			changes = append(changes, FieldChange{Field: field, Before: a, After: b})
+		}
+	}
+	diffTime := func(field string, a, b *time.Time) {
+		if a == nil || b == nil {
+			if a != b {
+				changes = append(changes, FieldChange{Field: field, Before: a, After: b})
+			}
+		} else if !a.Equal(*b) {
+			changes = append(changes, FieldChange{Field: field, Before: a, After: b})
+		}
+	}
+
+	diffValue("registrar", before.Registrar, after.Registrar)
+	diffList("statuses", before.Statuses, after.Statuses, normalizeStatus)
+	diffList("nameservers", before.Nameservers, after.Nameservers, normalizeNameserver)
+	diffTime("createDate", before.CreateDate, after.CreateDate)
+	diffTime("updateDate", before.UpdateDate, after.UpdateDate)
+	diffTime("registryExpirationDate", before.RegistryExpirationDate, after.RegistryExpirationDate)
+	diffTime("registrarExpirationDate", before.RegistrarExpirationDate, after.RegistrarExpirationDate)
+	diffValue("registrantName", before.RegistrantName, after.RegistrantName)
+	// Snapshots from before privacy was classified don't say, which isn't a change
+	if before.RegistrantPrivacy != "" {
+		diffValue("registrantPrivacy", before.RegistrantPrivacy, after.RegistrantPrivacy)
+		diffValue("privacyService", before.PrivacyService, after.PrivacyService)
+	}
+	diffValue("dnssec", before.Dnssec, after.Dnssec)
+	// A key rollover changes the DS records while DNSSEC stays on
+	diffList("dsData", dsStrings(before.DsData), dsStrings(after.DsData), strings.ToUpper)
+
+	return changes
+}
+
+func dsStrings(records []DsRecord) []string {
+	strs := make([]string, len(records))
+	for i, record := range records {
+		strs[i] = record.String()
+	}
+	return strs
+}
+
+// recordKey identifies a record regardless of its TTL, which counts down on every query to a recursive resolver.
+type recordKey struct {
+	name, rrtype, data string
+}
+
+func diffDns(before map[string][]DnsRecord, after map[string][]DnsRecord) DnsDiff {
+	diff := DnsDiff{Changes: make([]RecordChange, 0)}
+
+	for _, server := range slices.Sorted(maps.Keys(after)) {
+		beforeRecords, ok := before[server]
+		if !ok {
+			diff.ServersAdded = append(diff.ServersAdded, server)
+			continue
+		}
+
+		beforeSet := make(map[recordKey]DnsRecord)
+		for _, record := range beforeRecords {
+			beforeSet[recordKey{record.Name, record.Type, record.Data}] = record
+		}
+		afterSet := make(map[recordKey]DnsRecord)
+		for _, record := range after[server] {
+			afterSet[recordKey{record.Name, record.Type, record.Data}] = record
+		}
+
+		for key, record := range afterSet {
+			if _, ok := beforeSet[key]; !ok {
+				diff.Changes = append(diff.Changes, RecordChange{Server: server, Change: "added", Record: record})
+			}
+		}
+		for key, record := range beforeSet {
+			if _, ok := afterSet[key]; !ok {
+				diff.Changes = append(diff.Changes, RecordChange{Server: server, Change: "removed", Record: record})
+			}
+		}
+	}
+	for _, server := range slices.Sorted(maps.Keys(before)) {
+		if _, ok := after[server]; !ok {
+			diff.ServersRemoved = append(diff.ServersRemoved, server)
+		}
+	}
+
+	slices.SortFunc(diff.Changes, func(a, b RecordChange) int {
+		return cmp.Or(
+			cmp.Compare(a.Server, b.Server),
+			cmp.Compare(a.Record.Type, b.Record.Type),
+			cmp.Compare(a.Record.Name, b.Record.Name),
+			cmp.Compare(a.Record.Data, b.Record.Data),
+			cmp.Compare(a.Change, b.Change),
+		)
+	})
+
+	return diff
+}
+
+// parseLimitParam parses a `limit=` for listing a series, which defaults to defaultHistoryLimit.
+func parseLimitParam(s string) (int, error) {
+	if s == "" {
+		return defaultHistoryLimit, nil
+	}
+
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 || limit > maxHistoryLimit {
+		return 0, invalidInput(fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit))
+	}
+	return limit, nil
+}
+
+// parseTimeParam accepts RFC 3339 timestamps or plain dates, which are taken as the end of that day in UTC.
+func parseTimeParam(name string, s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	return time.Time{}, invalidInput(fmt.Errorf("%q is not a valid value for `%s`, expected an RFC 3339 time or a date", s, name))
+}
+
+// historyNames returns the names info and DNS history is recorded under for a hostname: info is recorded for the
+// registrable domain, DNS for the exact hostname that was asked about.
+func historyNames(req *http.Request) (string, string, error) {
+	if store == nil {
+		return "", "", newLookupError(ErrCodeNotFound, errors.New("history is not enabled"))
+	}
+
+	hostname, err := normalizeHostname(mux.Vars(req)["domain"])
+	if err != nil {
+		return "", "", err
+	}
+
+	domain, err := getTldAndSld(hostname)
+	if err != nil {
+		return "", "", err
+	}
+
+	return domain, hostname, nil
+}
+
+func historyInfo(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	domain, hostname, err := historyNames(req)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	limit, err := parseLimitParam(req.URL.Query().Get("limit"))
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	before, err := parseTimeParam("before", req.URL.Query().Get("before"), time.Now())
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	infoHistory, err := store.InfoHistory(domain, before, limit)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+	dnsHistory, err := store.DnsHistory(hostname, before, limit)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(HistoryResp{
+		Domain: hostname,
+		Info:   infoHistory,
+		Dns:    dnsHistory,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// historyDiff compares the snapshots in effect at `from` and `to`. `to` defaults to now, and `from` defaults to the
+// snapshot before the `to` one, so with no parameters it shows the most recent change.
+func historyDiff(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	domain, hostname, err := historyNames(req)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	query := req.URL.Query()
+	to, err := parseTimeParam("to", query.Get("to"), time.Now())
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+	from, err := parseTimeParam("from", query.Get("from"), time.Time{})
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+	if !from.IsZero() && from.After(to) {
+		writeError(w, encoder, invalidInput(errors.New("`from` must not be after `to`")))
+		return
+	}
+
+	resp := DiffResp{Domain: hostname}
+
+	infoFrom, infoTo, err := snapshotPair(func(before time.Time, limit int) ([]InfoSnapshot, error) {
+		return store.InfoHistory(domain, before, limit)
+	}, from, to)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+	if infoFrom != nil && infoTo != nil {
+		resp.Info = &InfoDiff{
+			From:    infoFrom.Time,
+			To:      infoTo.Time,
+			Changes: diffInfo(infoFrom.Info, infoTo.Info),
+		}
+	}
+
+	dnsFrom, dnsTo, err := snapshotPair(func(before time.Time, limit int) ([]DnsSnapshot, error) {
+		return store.DnsHistory(hostname, before, limit)
+	}, from, to)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+	if dnsFrom != nil && dnsTo != nil {
+		dnsDiff := diffDns(dnsFrom.Records, dnsTo.Records)
+		dnsDiff.From, dnsDiff.To = dnsFrom.Time, dnsTo.Time
+		resp.Dns = &dnsDiff
+	}
+
+	if resp.Info == nil && resp.Dns == nil {
+		writeError(w, encoder, newLookupError(ErrCodeNotFound, fmt.Errorf("not enough history for %s to compare", hostname)))
+		return
+	}
+
+	err = encoder.Encode(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// snapshotPair finds the snapshots in effect at from and to. A zero from means the snapshot before the `to` one.
+func snapshotPair[T any](list func(before time.Time, limit int) ([]T, error), from time.Time, to time.Time) (*T, *T, error) {
+	if from.IsZero() {
+		snapshots, err := list(to, 2)
+		if err != nil || len(snapshots) < 2 {
+			return nil, nil, err
+		}
+		return &snapshots[1], &snapshots[0], nil
+	}
+
+	toSnapshots, err := list(to, 1)
+	if err != nil || len(toSnapshots) == 0 {
+		return nil, nil, err
+	}
+	fromSnapshots, err := list(from, 1)
+	if err != nil || len(fromSnapshots) == 0 {
+		return nil, nil, err
+	}
+	return &fromSnapshots[0], &toSnapshots[0], nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// hostnameProfile implements UTS-46 non-transitional processing on top of IDNA2008: it maps user input the way a
+// browser would (case folding, full-width dots, etc.) and converts between U-labels and A-labels. StrictDomainName
+// is off because underscore labels such as "_dmarc" are valid DNS names; LDH rules are checked separately in
+// normalizeHostname.
+var hostnameProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.BidiRule(),
+	idna.ValidateLabels(true),
+	idna.StrictDomainName(false),
+)
+
+type IdnWarningKind string
+
+const (
+	// idnWarningMixedScript is a label that mixes scripts in a way no real language does, e.g. Latin and Cyrillic.
+	idnWarningMixedScript IdnWarningKind = "mixed-script"
+	// idnWarningConfusable is a label made up of characters that render like a different, all-ASCII label.
+	idnWarningConfusable IdnWarningKind = "confusable"
+)
+
+type IdnWarning struct {
+	Label  string         `json:"label"`
+	Kind   IdnWarningKind `json:"kind"`
+	Detail string         `json:"detail"`
+}
+
+// allowedScriptSets are the script combinations UTS-39's "highly restrictive" profile permits in a single label, on
+// top of any single script on its own.
+var allowedScriptSets = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// latinConfusables maps non-Latin characters to the ASCII letter they're usually indistinguishable from. This is the
+// subset of the Unicode confusables table that actually shows up in homograph phishing, not the whole thing.
+var latinConfusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'ӏ': 'l', 'о': 'o', 'р': 'p', 'ԛ': 'q',
+	'ѕ': 's', 'у': 'y', 'ԝ': 'w', 'х': 'x', 'ү': 'y',
+	// Greek
+	'α': 'a', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	// Armenian
+	'ց': 'g', 'հ': 'h', 'ո': 'n', 'օ': 'o', 'զ': 'q', 'ս': 'u',
+	// Latin look-alikes that survive UTS-46 mapping
+	'ı': 'i', 'ȷ': 'j', 'ɡ': 'g', 'ḷ': 'l', 'ṃ': 'm', 'ṇ': 'n', 'ọ': 'o', 'ạ': 'a', 'ẹ': 'e',
+}
+
+// toUnicode converts an A-label hostname to its U-label form. Names that don't convert cleanly (e.g. "@") are
+// returned as-is.
+func toUnicode(hostname string) string {
+	unicodeName, err := hostnameProfile.ToUnicode(hostname)
+	if err != nil {
+		return hostname
+	}
+	return unicodeName
+}
+
+func scriptOf(r rune) string {
+	if unicode.In(r, unicode.Common, unicode.Inherited) {
+		return ""
+	}
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+func isAllowedScriptSet(scripts []string) bool {
+	if len(scripts) <= 1 {
+		return true
+	}
+	for _, allowed := range allowedScriptSets {
+		if !slices.ContainsFunc(scripts, func(s string) bool { return !slices.Contains(allowed, s) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// idnWarnings flags the labels of a U-label hostname that are commonly used for homograph attacks. ASCII labels are
+// never flagged.
+func idnWarnings(hostname string) []IdnWarning {
+	var warnings []IdnWarning
+
+	for _, label := range strings.Split(hostname, ".") {
+		if isASCII(label) {
+			continue
+		}
+
+		scriptSet := make(map[string]struct{})
+		var skeleton strings.Builder
+		for _, r := range label {
+			if script := scriptOf(r); script != "" {
+				scriptSet[script] = struct{}{}
+			}
+			if latin, ok := latinConfusables[r]; ok {
+				skeleton.WriteRune(latin)
+			} else {
+				skeleton.WriteRune(r)
+			}
+		}
+
+		scripts := make([]string, 0, len(scriptSet))
+		for script := range scriptSet {
+			scripts = append(scripts, script)
+		}
+		sort.Strings(scripts)
+
+		if !isAllowedScriptSet(scripts) {
+			warnings = append(warnings, IdnWarning{
+				Label:  label,
+				Kind:   idnWarningMixedScript,
+				Detail: fmt.Sprintf("mixes %s", strings.Join(scripts, ", ")),
+			})
+		}
+
+		if lookalike := skeleton.String(); isASCII(lookalike) {
+			warnings = append(warnings, IdnWarning{
+				Label:  label,
+				Kind:   idnWarningConfusable,
+				Detail: fmt.Sprintf("looks like %q", lookalike),
+			})
+		}
+	}
+
+	return warnings
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -4,25 +4,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/domainr/whois"
 	whoisparser "github.com/likexian/whois-parser"
 	"github.com/openrdap/rdap"
 	"github.com/zonedb/zonedb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type DomainInfo struct {
 	Source                  string     `json:"source"`
 	Domain                  string     `json:"domain"`
+	DomainUnicode           string     `json:"domainUnicode"`
 	Registrar               string     `json:"registrar"`
 	Statuses                []string   `json:"statuses"`
 	Nameservers             []string   `json:"nameservers"`
@@ -32,6 +35,37 @@ type DomainInfo struct {
 	RegistrarExpirationDate *time.Time `json:"registrarExpirationDate"`
 	RegistrantName          *string    `json:"registrantName"`
 	Dnssec                  bool       `json:"dnssec"`
+	// RegistrantPrivacy says why RegistrantName is null, if it is. It's only set to a real name when this is public.
+	RegistrantPrivacy RegistrantPrivacy `json:"registrantPrivacy"`
+	// PrivacyService names the proxy service registered in the registrant's place when RegistrantPrivacy is proxy.
+	PrivacyService *string `json:"privacyService"`
+	// DsData are the DS records the registry lists for the domain, which only RDAP gives.
+	DsData []DsRecord `json:"dsData,omitempty"`
+	// RegistrarIanaId is left out if the registrar doesn't have one, or it couldn't be found.
+	RegistrarIanaId int `json:"registrarIanaId,omitempty"`
+	// RegistrarDetails is what IANA's registrar list says about the registrar, if it's listed.
+	RegistrarDetails *Registrar `json:"registrarDetails,omitempty"`
+	// Query is the name that was asked about, which is Domain or a name under it.
+	Query string `json:"query"`
+	// PublicSuffix is how the Public Suffix List reads Query, which can disagree with Domain for names under private
+	// suffixes.
+	PublicSuffix PublicSuffixInfo `json:"publicSuffix"`
+	// WhoisChain is every server a WHOIS lookup asked, following referrals from the registry's.
+	WhoisChain []WhoisHop `json:"whoisChain,omitempty"`
+	// TimedOut lists the stages whose budget elapsed. When it's non-empty the rest of the info is a partial result
+	// from whichever stages did answer.
+	TimedOut []Stage `json:"timedOut,omitempty"`
+	// IdnWarnings flags labels that look like they're impersonating another name.
+	IdnWarnings []IdnWarning `json:"idnWarnings,omitempty"`
+
+	// Provenance, Sources and Conflicts are only filled in by merged lookups. Provenance maps each field's JSON name
+	// to the source it was taken from, and Sources says where each of those sources lives.
+	Provenance map[string]InfoSource `json:"provenance,omitempty"`
+	Sources    map[InfoSource]string `json:"sources,omitempty"`
+	Conflicts  []FieldConflict       `json:"conflicts,omitempty"`
+
+	// Raw is only returned when asked for with InfoOptions.IncludeRaw.
+	Raw []RawResponse `json:"raw,omitempty"`
 }
 
 type LookupType uint8
@@ -40,14 +74,16 @@ const (
 	lookupTypeAuto LookupType = iota
 	lookupTypeRdap
 	lookupTypeWhois
+	lookupTypeMerged
 )
 
 var (
 	LookupTypeValue = map[string]LookupType{
-		"":      lookupTypeAuto,
-		"auto":  lookupTypeAuto,
-		"rdap":  lookupTypeRdap,
-		"whois": lookupTypeWhois,
+		"":       lookupTypeAuto,
+		"auto":   lookupTypeAuto,
+		"rdap":   lookupTypeRdap,
+		"whois":  lookupTypeWhois,
+		"merged": lookupTypeMerged,
 	}
 )
 
@@ -81,11 +117,31 @@ func ParseLookupSource(s string) (LookupSource, error) {
 	s = strings.TrimSpace(strings.ToLower(s))
 	value, ok := LookupSourceValue[s]
 	if !ok {
-		return lookupSourceAuto, fmt.Errorf("%q is not a valid lookup type", s)
+		return lookupSourceAuto, fmt.Errorf("%q is not a valid lookup source", s)
 	}
 	return value, nil
 }
 
+// InfoOptions controls how GetInfo looks a domain up.
+type InfoOptions struct {
+	Type   LookupType
+	Source LookupSource
+	// Precedence orders the sources a merged lookup takes each field from. Defaults to defaultMergePrecedence.
+	Precedence []InfoSource
+	// IncludeRaw returns the upstream responses alongside the parsed info.
+	IncludeRaw bool
+	// PrivateSuffix is what to report about a name under a private suffix.
+	PrivateSuffix PrivateSuffixMode
+}
+
+// recordsHistory is whether a lookup made with these options goes in the domain's history. Only lookups made the way
+// the watcher makes them do, so the history compares like with like: a WHOIS lookup between two RDAP ones would
+// otherwise show the registrar, statuses and dates changing when only the source did.
+func (o InfoOptions) recordsHistory() bool {
+	return o.Type == lookupTypeAuto && o.Source == lookupSourceAuto && len(o.Precedence) == 0 &&
+		o.PrivateSuffix == privateSuffixRegistrable
+}
+
 func getTldAndSld(domain string) (string, error) {
 	// Returns the "com" zone or "co.uk" zone.
 	// This is preferred to the PSL because it will say "amazonaws.com" is an
@@ -93,7 +149,7 @@ func getTldAndSld(domain string) (string, error) {
 	zone := zonedb.PublicZone(strings.ToLower(domain))
 
 	if zone == nil {
-		return "", errors.New("unable to determine second-level domain")
+		return "", invalidInput(errors.New("unable to determine second-level domain"))
 	}
 
 	dotsInZone := strings.Count(zone.Domain, ".")
@@ -103,124 +159,177 @@ func getTldAndSld(domain string) (string, error) {
 	return strings.Join(parts[partsToSkip:], "."), nil
 }
 
-func GetInfo(lookupType LookupType, domain string, lookupSource LookupSource) (DomainInfo, error) {
+// normalizeSuffix is the form domain suffixes are configured in: lowercase, without leading or trailing dots.
+func normalizeSuffix(suffix string) string {
+	return strings.ToLower(strings.Trim(suffix, "."))
+}
+
+// matchSuffix looks domain up in a table keyed by domain suffix, longest suffix first, so "co.uk" can be configured
+// separately from "uk".
+func matchSuffix[T any](table map[string]T, domain string) (T, bool) {
+	for suffix := normalizeSuffix(domain); suffix != ""; {
+		if v, ok := table[suffix]; ok {
+			return v, true
+		}
+		_, suffix, _ = strings.Cut(suffix, ".")
+	}
+	var zero T
+	return zero, false
+}
+
+func GetInfo(ctx context.Context, domain string, opts InfoOptions) (DomainInfo, error) {
+	ctx, span := tracer.Start(ctx, "GetInfo", trace.WithAttributes(attribute.String("domain", domain)))
+	info, err := getInfo(ctx, domain, opts)
+	endSpan(span, err)
+	return info, err
+}
+
+func getInfo(ctx context.Context, domain string, opts InfoOptions) (DomainInfo, error) {
 	var info DomainInfo
 	var err error
+	var timedOut []Stage
+	lookupType, lookupSource := opts.Type, opts.Source
 
+	domain, err = normalizeHostname(domain)
+	if err != nil {
+		return DomainInfo{}, err
+	}
+
+	query := domain
 	domain, err = getTldAndSld(domain)
 	if err != nil {
 		return DomainInfo{}, err
 	}
 
+	if lookupType == lookupTypeMerged {
+		precedence := opts.Precedence
+		if len(precedence) == 0 {
+			precedence = defaultMergePrecedence
+		}
+
+		info, err = getMergedInfo(ctx, domain, lookupSource, precedence)
+		if err != nil {
+			return DomainInfo{}, err
+		}
+		return finishInfo(info, query, opts), nil
+	}
+
 	if lookupType == lookupTypeAuto || lookupType == lookupTypeRdap {
-		info, err = getRdapInfo(domain, lookupSource)
+		info, err = getRdapInfo(ctx, domain, lookupSource)
 		if err == nil {
-			return info, err
+			return finishInfo(info, query, opts), err
+		}
+		if isTimeout(err) {
+			timedOut = append(timedOut, StageRegistry)
+		}
+		if lookupType == lookupTypeAuto {
+			observeFallback(upstreamRdap, upstreamWhois)
 		}
 	}
 
 	if lookupType == lookupTypeAuto || lookupType == lookupTypeWhois {
-		info, err = getWhoisInfo(domain, lookupSource)
+		info, err = getWhoisInfo(ctx, domain, lookupSource)
 		if err == nil {
-			return info, err
+			info.TimedOut = slices.Concat(timedOut, info.TimedOut)
+			return finishInfo(info, query, opts), err
 		}
 	}
 
 	return DomainInfo{}, err
 }
 
-func getRdapInfo(domain string, lookupSource LookupSource) (DomainInfo, error) {
-	var verboseFunc func(string)
-	if s, err := strconv.ParseBool(os.Getenv("VERBOSE")); err == nil && s {
-		verboseFunc = func(s string) {
-			fmt.Println(s)
-		}
+// finishInfo fills in the parts of a DomainInfo that don't depend on where it came from.
+func finishInfo(info DomainInfo, query string, opts InfoOptions) DomainInfo {
+	if !opts.IncludeRaw {
+		info.Raw = nil
 	}
+	return withPublicSuffix(withRegistrarDetails(withIdnForms(info)), query, opts.PrivateSuffix)
+}
 
-	sourceIp := os.Getenv("SOURCE_IP")
-	if sourceIp == "" {
-		sourceIp = "0.0.0.0"
-	}
+// withIdnForms fills in the U-label form of the domain and flags it if it looks like a homograph.
+func withIdnForms(info DomainInfo) DomainInfo {
+	info.DomainUnicode = toUnicode(info.Domain)
+	info.IdnWarnings = idnWarnings(info.DomainUnicode)
+	return info
+}
 
-	dialer := &net.Dialer{
-		LocalAddr: &net.TCPAddr{IP: net.ParseIP(sourceIp), Port: 0},
-	}
+// rdapLookup holds the RDAP documents fetched for a domain before they're boiled down into a DomainInfo. registrar
+// is nil if the registrar wasn't asked or didn't answer.
+type rdapLookup struct {
+	registry     *rdap.Domain
+	registryUrl  string
+	registrar    *rdap.Domain
+	registrarUrl string
+	raw          []RawResponse
+	timedOut     []Stage
+}
 
-	client := &rdap.Client{
-		Verbose: verboseFunc,
-		HTTP: &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					conn, err := dialer.Dial(network, addr)
-					return conn, err
-				},
-			},
-		},
+func getRdapInfo(ctx context.Context, domain string, lookupSource LookupSource) (DomainInfo, error) {
+	lookup, err := fetchRdap(ctx, domain, lookupSource)
+	if err != nil {
+		return DomainInfo{}, err
 	}
 
-	var rdapDomain *rdap.Domain
+	return lookup.info(domain)
+}
+
+func fetchRdap(ctx context.Context, domain string, lookupSource LookupSource) (rdapLookup, error) {
+	tld := tldOf(domain)
 
-	rdapResp, err := client.Do(&rdap.Request{
+	var lookup rdapLookup
+
+	registryCtx, cancelRegistry := stageContext(ctx, StageRegistry)
+	defer cancelRegistry()
+
+	rdapResp, err := rdapClient.Do(registryCtx, &rdap.Request{
 		Type:       rdap.DomainRequest,
 		Query:      domain,
 		Params:     nil,
 		FetchRoles: nil,
-	})
+	}, tld)
 	if err != nil {
-		return DomainInfo{}, errors.Join(errors.New("failed to get Registry RDAP"), err)
+		return rdapLookup{}, rdapError(rdapResp, errors.New("failed to get Registry RDAP"), err)
 	}
 
 	if domain, ok := rdapResp.Object.(*rdap.Domain); ok {
-		rdapDomain = domain
-	} else {
-		return DomainInfo{}, errors.Join(errors.New("failed to parse Registry RDAP"), err)
-	}
-	registryRdapDomain := rdapDomain
-
-	registrarIdx := slices.IndexFunc(rdapDomain.Entities, func(e rdap.Entity) bool {
-		return slices.Contains(e.Roles, "registrar")
-	})
-
-	registrar := ""
-	registrarIanaId := 0
-	if registrarIdx >= 0 {
-		entity := rdapDomain.Entities[registrarIdx]
-
-		if entity.VCard != nil {
-			// VCard shouldn't be null, but can be if parsing fails due to bad RDAP implementation (seen with
-			// CentralNIC)
-			registrar = entity.VCard.Name()
-		}
-
-		ianaIdIdx := slices.IndexFunc(entity.PublicIDs, func(e rdap.PublicID) bool {
-			return strings.ToLower(e.Type) == "iana registrar id"
-		})
-		if ianaIdIdx >= 0 {
-			registrarIanaId, err = strconv.Atoi(entity.PublicIDs[ianaIdIdx].Identifier)
+		lookup.registry = domain
+		lookup.registryUrl = lastRdapUrl(rdapResp)
+		if raw, ok := rawRdapResponse(sourceRegistryRdap, rdapResp); ok {
+			lookup.raw = append(lookup.raw, raw)
 		}
+	} else {
+		return rdapLookup{}, parseFailure(errors.New("failed to parse Registry RDAP"))
 	}
 
 	if lookupSource != lookupSourceRegistry {
-		registrarIdx := slices.IndexFunc(rdapDomain.Links, func(e rdap.Link) bool {
+		registrarIdx := slices.IndexFunc(lookup.registry.Links, func(e rdap.Link) bool {
 			return e.Rel == "related"
 		})
 
 		registrar := ""
 		if registrarIdx >= 0 {
-			registrar = rdapDomain.Links[registrarIdx].Href
+			registrar = lookup.registry.Links[registrarIdx].Href
 			registrarUrl, err := url.Parse(registrar)
 
 			if err != nil {
-				return DomainInfo{}, errors.Join(errors.New("failed to parse registrar URL"), err)
+				return rdapLookup{}, parseFailure(errors.New("failed to parse registrar URL"), err)
 			}
 
-			rdapResp, err = client.Do(&rdap.Request{
+			registrarCtx, cancelRegistrar := stageContext(ctx, StageRegistrar)
+			defer cancelRegistrar()
+
+			rdapResp, err = rdapClient.Do(registrarCtx, &rdap.Request{
 				Type:       rdap.RawRequest, // We already have the full URL, don't append anything
 				Query:      domain,
 				Params:     nil,
 				Server:     registrarUrl,
 				FetchRoles: nil,
-			})
+			}, tld)
+
+			// Keep what the registrar said even if it was an error, it's the most likely thing to need debugging
+			if raw, ok := rawRdapResponse(sourceRegistrarRdap, rdapResp); ok {
+				lookup.raw = append(lookup.raw, raw)
+			}
 
 			if err != nil {
 				if rdapResp != nil {
@@ -228,22 +337,72 @@ func getRdapInfo(domain string, lookupSource LookupSource) (DomainInfo, error) {
 						var messages []string
 						messages = append(messages, rErr.Title)
 						messages = slices.Concat(messages, rErr.Description)
-						return DomainInfo{}, errors.Join(errors.New("failed to fetch registrar RDAP"), errors.New(strings.Join(messages, ";")))
+						return rdapLookup{}, rdapError(rdapResp, errors.New("failed to fetch registrar RDAP"), errors.New(strings.Join(messages, ";")))
 					}
 				}
 				if lookupSource == lookupSourceRegistrar {
 					// If the source is auto we should just fall back to the registry
-					return DomainInfo{}, errors.Join(errors.New("failed to fetch registrar RDAP"), err)
+					return rdapLookup{}, rdapError(rdapResp, errors.New("failed to fetch registrar RDAP"), err)
+				}
+				if isTimeout(err) {
+					lookup.timedOut = append(lookup.timedOut, StageRegistrar)
 				}
+				observeFallback(string(sourceRegistrarRdap), string(sourceRegistryRdap))
 			} else {
 				if domain, ok := rdapResp.Object.(*rdap.Domain); ok {
-					rdapDomain = domain
+					lookup.registrar = domain
+					lookup.registrarUrl = lastRdapUrl(rdapResp)
 				}
 			}
 		}
 
 	}
 
+	return lookup, nil
+}
+
+func lastRdapUrl(resp *rdap.Response) string {
+	if resp == nil || len(resp.HTTP) == 0 {
+		return ""
+	}
+	return resp.HTTP[len(resp.HTTP)-1].URL
+}
+
+// info boils the lookup down into a DomainInfo. The registrar's document is preferred when there is one, but the
+// registry is authoritative for its own expiration date and for who the registrar is.
+func (l rdapLookup) info(domain string) (DomainInfo, error) {
+	rdapDomain, sourceUrl := l.registry, l.registryUrl
+	if l.registrar != nil {
+		rdapDomain, sourceUrl = l.registrar, l.registrarUrl
+	}
+	registrarSource := l.registry
+	if registrarSource == nil {
+		registrarSource = rdapDomain
+	}
+
+	registrarIdx := slices.IndexFunc(registrarSource.Entities, func(e rdap.Entity) bool {
+		return slices.Contains(e.Roles, "registrar")
+	})
+
+	registrar := ""
+	registrarIanaId := 0
+	if registrarIdx >= 0 {
+		entity := registrarSource.Entities[registrarIdx]
+
+		if entity.VCard != nil {
+			// VCard shouldn't be null, but can be if parsing fails due to bad RDAP implementation (seen with
+			// CentralNIC)
+			registrar = entity.VCard.Name()
+		}
+
+		ianaIdIdx := slices.IndexFunc(entity.PublicIDs, func(e rdap.PublicID) bool {
+			return strings.ToLower(e.Type) == "iana registrar id"
+		})
+		if ianaIdIdx >= 0 {
+			registrarIanaId, _ = strconv.Atoi(entity.PublicIDs[ianaIdIdx].Identifier)
+		}
+	}
+
 	var nameservers []string
 
 	for _, ns := range rdapDomain.Nameservers {
@@ -258,61 +417,70 @@ func getRdapInfo(domain string, lookupSource LookupSource) (DomainInfo, error) {
 	for _, evt := range rdapDomain.Events {
 		eventTime, err := time.Parse(time.RFC3339, evt.Date)
 		if err != nil {
-			return DomainInfo{}, errors.Join(errors.New("failed to parse event"), err)
+			return DomainInfo{}, parseFailure(errors.New("failed to parse event"), err)
 		}
 		if evt.Action == "registration" {
 			created = &eventTime
-		} else if evt.Action == "registrar expiration" && rdapDomain != registryRdapDomain {
+		} else if evt.Action == "registrar expiration" && rdapDomain == l.registrar {
 			registrarExpirationDate = &eventTime
 		} else if evt.Action == "last changed" {
 			updated = &eventTime
 		}
 	}
 
-	for _, evt := range registryRdapDomain.Events {
-		eventTime, err := time.Parse(time.RFC3339, evt.Date)
-		if err != nil {
-			return DomainInfo{}, errors.Join(errors.New("failed to parse event"), err)
-		}
-		if evt.Action == "expiration" {
-			registryExpirationDate = &eventTime
+	if l.registry != nil {
+		for _, evt := range l.registry.Events {
+			eventTime, err := time.Parse(time.RFC3339, evt.Date)
+			if err != nil {
+				return DomainInfo{}, parseFailure(errors.New("failed to parse event"), err)
+			}
+			if evt.Action == "expiration" {
+				registryExpirationDate = &eventTime
+			}
 		}
 	}
 
-	dnssec := rdapDomain.SecureDNS.DelegationSigned != nil && (*rdapDomain.SecureDNS.DelegationSigned)
-
-	registrantIdx := slices.IndexFunc(rdapDomain.Entities, func(e rdap.Entity) bool {
-		return slices.Contains(e.Roles, "registrant")
-	})
+	dnssec := rdapDomain.SecureDNS != nil && rdapDomain.SecureDNS.DelegationSigned != nil &&
+		(*rdapDomain.SecureDNS.DelegationSigned)
 
-	var registrantName *string
-	if registrantIdx >= 0 {
-		registrant := rdapDomain.Entities[registrantIdx].VCard
-		if registrant != nil {
-			if registrant.Name() != "" {
-				name := registrant.Name()
-				registrantName = &name
-			} else {
-				org := registrant.GetFirst("org")
-				if org != nil && registrant.GetFirst("org").Values()[0] != "" {
-					name := registrant.GetFirst("org").Values()[0]
-					registrantName = &name
-				}
+	// The registry is the one that publishes the DS records, so it's trusted over the registrar
+	secureDns := rdapDomain.SecureDNS
+	if l.registry != nil && l.registry.SecureDNS != nil {
+		secureDns = l.registry.SecureDNS
+	}
+	var dsData []DsRecord
+	if secureDns != nil {
+		for _, ds := range secureDns.DS {
+			if ds.KeyTag == nil || ds.Algorithm == nil || ds.DigestType == nil {
+				continue
 			}
+			dsData = append(dsData, DsRecord{
+				KeyTag:     uint16(*ds.KeyTag),
+				Algorithm:  *ds.Algorithm,
+				DigestType: *ds.DigestType,
+				Digest:     strings.ToUpper(ds.Digest),
+			})
 		}
 	}
 
-	var sourceUrl = ""
+	registrantIdx := slices.IndexFunc(rdapDomain.Entities, func(e rdap.Entity) bool {
+		return slices.Contains(e.Roles, "registrant")
+	})
 
-	if rdapResp != nil {
-		sourceUrl = rdapResp.HTTP[0].URL
+	var registrant *rdap.Entity
+	if registrantIdx >= 0 {
+		registrant = &rdapDomain.Entities[registrantIdx]
 	}
+	privacy, registrantName, privacyService := classifyRegistrant(rdapRegistrantCandidates(rdapDomain, registrant)...)
 
 	return DomainInfo{
 		Source:                  fmt.Sprintf("RDAP (%s)", sourceUrl),
 		Domain:                  domain,
 		Registrar:               fmt.Sprintf("%s (IANA %d)", registrar, registrarIanaId),
+		RegistrarIanaId:         registrarIanaId,
 		RegistrantName:          registrantName,
+		RegistrantPrivacy:       privacy,
+		PrivacyService:          privacyService,
 		Statuses:                rdapDomain.Status,
 		Nameservers:             nameservers,
 		CreateDate:              created,
@@ -320,96 +488,272 @@ func getRdapInfo(domain string, lookupSource LookupSource) (DomainInfo, error) {
 		RegistryExpirationDate:  registryExpirationDate,
 		RegistrarExpirationDate: registrarExpirationDate,
 		Dnssec:                  dnssec,
+		DsData:                  dsData,
+		TimedOut:                l.timedOut,
+		Raw:                     l.raw,
 	}, nil
 }
 
-func getWhoisInfo(domain string, lookupSource LookupSource) (DomainInfo, error) {
-	sourceIp := os.Getenv("SOURCE_IP")
-	if sourceIp == "" {
-		sourceIp = "0.0.0.0"
+// rdapError joins errs, tagging them as rate limited if any RDAP server answered with a 429. The client library
+// reports that as a generic "no working servers" error.
+func rdapError(resp *rdap.Response, errs ...error) error {
+	if resp != nil {
+		for _, httpResp := range resp.HTTP {
+			if httpResp.Response != nil && httpResp.Response.StatusCode == http.StatusTooManyRequests {
+				return newLookupError(ErrCodeRateLimited, errs...)
+			}
+		}
 	}
 
-	dialer := &net.Dialer{
-		LocalAddr: &net.TCPAddr{IP: net.ParseIP(sourceIp), Port: 0},
+	return errors.Join(errs...)
+}
+
+// whoisLookup holds the parsed WHOIS responses for a domain before they're boiled down into a DomainInfo. registrar
+// is the last server in the referral chain that answered, and nil if the registry didn't refer us anywhere, or none
+// of the referrals were asked or answered.
+type whoisLookup struct {
+	registry      *whoisparser.WhoisInfo
+	registryHost  string
+	registrar     *whoisparser.WhoisInfo
+	registrarHost string
+	chain         []WhoisHop
+	raw           []RawResponse
+	timedOut      []Stage
+}
+
+func getWhoisInfo(ctx context.Context, domain string, lookupSource LookupSource) (DomainInfo, error) {
+	lookup, err := fetchWhois(ctx, domain, lookupSource)
+	if err != nil {
+		return DomainInfo{}, err
 	}
 
-	whoisClient := whois.NewClient(time.Duration(10) * time.Second)
-	whoisClient.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		conn, err := dialer.Dial(network, addr)
+	return lookup.info(domain)
+}
+
+// whoisQuerier makes the WHOIS queries for one lookup, one at a time.
+type whoisQuerier struct {
+	client *whois.Client
+	domain string
+	logger *slog.Logger
+	// local is the source address of the last query's connection
+	local net.Addr
+}
+
+func newWhoisQuerier(ctx context.Context, domain string) *whoisQuerier {
+	q := &whoisQuerier{
+		// The timeout comes from the stage context instead
+		client: whois.NewClient(0),
+		domain: domain,
+		logger: loggerFrom(ctx).With("domain", domain),
+	}
+	q.client.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := sourcePool.DialContext(ctx, network, address)
+		if err == nil {
+			q.local = conn.LocalAddr()
+		}
 		return conn, err
 	}
-	request, err := whois.NewRequest(domain)
+	return q
+}
+
+// fetch sends request once the rate limiter allows it. A server that refuses to answer because we've hit its query
+// limit is backed off from, and the source address we used rests from it.
+func (q *whoisQuerier) fetch(ctx context.Context, request *whois.Request, source InfoSource) (*whois.Response, error) {
+	if err := rateLimiter.Wait(ctx, upstreamWhois, request.Host); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	spanCtx, span := startUpstreamSpan(ctx, upstreamWhois, request.Host, attribute.String("whois.source", string(source)))
+	queryCtx, cancelQuery := upstreamContext(spanCtx, request.Host)
+	result, err := q.client.FetchContext(queryCtx, request)
+	cancelQuery()
+	if err == nil && whoisRateLimited(result.String()) {
+		sourcePool.CoolDown(request.Host, q.local)
+		rateLimiter.Backoff(upstreamWhois, request.Host)
+		err = newLookupError(ErrCodeRateLimited, fmt.Errorf("%s refused the query: %s", request.Host, strings.TrimSpace(result.String())))
+	}
+	endSpan(span, err)
+	observeUpstream(upstreamWhois, tldOf(q.domain), request.Host, start, err)
+	q.logger.Debug("whois query", "host", request.Host, "duration", time.Since(start), "err", err)
+
+	return result, err
+}
+
+func fetchWhois(ctx context.Context, domain string, lookupSource LookupSource) (whoisLookup, error) {
+	querier := newWhoisQuerier(ctx, domain)
+	var lookup whoisLookup
+
+	request, err := newWhoisRequest(domain, "")
 	if err != nil {
-		return DomainInfo{}, errors.Join(errors.New("failed to create Whois request"), err)
+		return whoisLookup{}, invalidInput(errors.New("failed to create Whois request"), err)
 	}
-	result, err := whoisClient.Fetch(request)
+	registryCtx, cancelRegistry := stageContext(ctx, StageWhois)
+	defer cancelRegistry()
+	result, err := querier.fetch(registryCtx, request, sourceRegistryWhois)
 	if err != nil {
-		return DomainInfo{}, errors.Join(errors.New("failed to get Whois info"), err)
+		return whoisLookup{}, errors.Join(errors.New("failed to get Whois info"), err)
 	}
-	println(result.String())
-	parsedWhois, err := whoisparser.Parse(result.String())
+	lookup.raw = append(lookup.raw, rawWhoisResponse(sourceRegistryWhois, result))
+	parsedWhois, err := parseWhois(domain, result.String())
 	if err != nil {
-		return DomainInfo{}, errors.Join(errors.New("failed to parse Whois request"), err)
+		return whoisLookup{}, withFallbackCode(ErrCodeParseFailure, errors.New("failed to parse Whois request"), err)
+	}
+
+	lookup.registry = &parsedWhois
+	lookup.registryHost = result.Host
+	lookup.chain = append(lookup.chain, WhoisHop{Source: sourceRegistryWhois, Server: result.Host})
+	if lookupSource == lookupSourceRegistry {
+		return lookup, nil
 	}
 
-	parsedRegistryWhois := parsedWhois
+	// Follow referrals for as long as each server has someone more specific to send us to. Registrars sometimes
+	// refer back to the registry, or to each other, so every server is only asked once.
+	asked := map[string]bool{strings.ToLower(result.Host): true}
+	host, referral := strings.ToLower(result.Host), whoisReferral(&parsedWhois)
+	var referralErr error
+	for hops := 0; referral != "" && referral != host; hops++ {
+		if asked[referral] {
+			lookup.chain = append(lookup.chain, WhoisHop{Source: sourceRegistrarWhois, Server: referral, Error: "referral loop, not asked again"})
+			break
+		}
+		if hops == config.Whois.MaxReferrals {
+			lookup.chain = append(lookup.chain, WhoisHop{Source: sourceRegistrarWhois, Server: referral, Error: "too many referrals, not asked"})
+			break
+		}
+		asked[referral] = true
+		host = referral
+
+		var parsedRegistrarWhois whoisparser.WhoisInfo
+		parsedRegistrarWhois, referralErr = querier.fetchReferral(ctx, &lookup, referral)
+		if referralErr != nil {
+			lookup.chain = append(lookup.chain, WhoisHop{Source: sourceRegistrarWhois, Server: referral, Error: referralErr.Error()})
+			break
+		}
+		lookup.chain = append(lookup.chain, WhoisHop{Source: sourceRegistrarWhois, Server: referral})
+		lookup.registrar = &parsedRegistrarWhois
+		lookup.registrarHost = referral
+		referral = whoisReferral(&parsedRegistrarWhois)
+	}
 
-	if parsedWhois.Domain.WhoisServer != "" && lookupSource != lookupSourceRegistry {
-		cleanHost := strings.TrimFunc(parsedWhois.Domain.WhoisServer, func(r rune) bool {
-			return r == '/' || unicode.IsSpace(r)
-		})
-		request := &whois.Request{
-			Query: domain,
-			Host:  cleanHost,
+	if referralErr != nil && lookup.registrar == nil {
+		if lookupSource == lookupSourceRegistrar {
+			return whoisLookup{}, referralErr
 		}
-		err := request.Prepare()
-		if err != nil {
-			return DomainInfo{}, errors.Join(errors.New("failed to create registrar Whois request"), err)
+		observeFallback(string(sourceRegistrarWhois), string(sourceRegistryWhois))
+	}
+
+	return lookup, nil
+}
+
+// fetchReferral asks host, which a previous server referred us to, about the domain.
+func (q *whoisQuerier) fetchReferral(ctx context.Context, lookup *whoisLookup, host string) (whoisparser.WhoisInfo, error) {
+	request, err := newWhoisRequest(q.domain, host)
+	if err != nil {
+		return whoisparser.WhoisInfo{}, errors.Join(errors.New("failed to create registrar Whois request"), err)
+	}
+
+	registrarCtx, cancelRegistrar := stageContext(ctx, StageWhois)
+	defer cancelRegistrar()
+	result, err := q.fetch(registrarCtx, request, sourceRegistrarWhois)
+	if err != nil {
+		if isTimeout(err) {
+			lookup.timedOut = append(lookup.timedOut, StageWhois)
 		}
-		registrarResult, err := whoisClient.Fetch(request)
-		if err != nil {
-			if lookupSource == lookupSourceRegistrar {
-				return DomainInfo{}, errors.Join(errors.New("failed to get registrar Whois info"), err)
-			}
-		} else {
-			println(registrarResult.String())
-			parsedRegistrarWhois, err := whoisparser.Parse(registrarResult.String())
-			if err != nil {
-				if lookupSource == lookupSourceRegistrar {
-					return DomainInfo{}, errors.Join(errors.New("failed to parse registrar Whois request"), err)
-				}
-			} else {
-				result = registrarResult
-				parsedWhois = parsedRegistrarWhois
-			}
+		return whoisparser.WhoisInfo{}, errors.Join(errors.New("failed to get registrar Whois info"), err)
+	}
+	lookup.raw = append(lookup.raw, rawWhoisResponse(sourceRegistrarWhois, result))
+
+	parsed, err := parseWhois(q.domain, result.String())
+	if err != nil {
+		return whoisparser.WhoisInfo{}, withFallbackCode(ErrCodeParseFailure, errors.New("failed to parse registrar Whois request"), err)
+	}
+	return parsed, nil
+}
+
+var whoisIanaIdRegex = regexp.MustCompile(`(?im)^\s*registrar iana id:\s*(\d+)\s*$`)
+
+// registrarIanaId is the registrar's IANA ID from registrarSource, if it has one we can trust. gTLD registries give
+// the IANA ID as the registrar's ID, but others tend to give their own handle for the registrar, which could be
+// anyone's IANA ID, so for them only an explicit "Registrar IANA ID" line counts.
+func (l whoisLookup) registrarIanaId(domain string, registrarSource *whoisparser.WhoisInfo) int {
+	if isGtld(domain) {
+		ianaId, _ := strconv.Atoi(registrarSource.Registrar.ID)
+		return ianaId
+	}
+
+	source := sourceRegistryWhois
+	if registrarSource != l.registry {
+		source = sourceRegistrarWhois
+	}
+	for _, raw := range l.raw {
+		if raw.Source != source {
+			continue
 		}
+		if match := whoisIanaIdRegex.FindStringSubmatch(raw.Text); match != nil {
+			ianaId, _ := strconv.Atoi(match[1])
+			return ianaId
+		}
+	}
+	return 0
+}
+
+// info boils the lookup down into a DomainInfo. The registrar's response is preferred when there is one, but the
+// registry is authoritative for its own expiration date and for who the registrar is.
+func (l whoisLookup) info(domain string) (DomainInfo, error) {
+	parsedWhois, host := l.registry, l.registryHost
+	if l.registrar != nil {
+		parsedWhois, host = l.registrar, l.registrarHost
+	}
+	registrarSource := l.registry
+	if registrarSource == nil {
+		registrarSource = parsedWhois
 	}
 
 	if parsedWhois.Domain == nil {
-		return DomainInfo{}, errors.New("no domain in parsed Whois info")
+		return DomainInfo{}, parseFailure(errors.New("no domain in parsed Whois info"))
 	}
 
-	var registrantName *string
-	if parsedWhois.Registrant != nil && parsedWhois.Registrant.Name != "" {
-		registrantName = &parsedWhois.Registrant.Name
+	var candidates []string
+	if parsedWhois.Registrant != nil {
+		candidates = append(candidates, parsedWhois.Registrant.Name, parsedWhois.Registrant.Organization)
+	}
+	privacy, registrantName, privacyService := classifyRegistrant(candidates...)
+
+	registrar := ""
+	registrarIanaId := 0
+	if registrarSource.Registrar != nil {
+		registrar = registrarSource.Registrar.Name
+		registrarIanaId = l.registrarIanaId(domain, registrarSource)
+	}
+
+	var registryExpirationDate *time.Time
+	if l.registry != nil && l.registry.Domain != nil {
+		registryExpirationDate = l.registry.Domain.ExpirationDateInTime
 	}
 
 	var registrarExpirationDate *time.Time
-	if parsedRegistryWhois != parsedWhois {
+	if parsedWhois == l.registrar {
 		registrarExpirationDate = parsedWhois.Domain.ExpirationDateInTime
 	}
 
 	return DomainInfo{
-		Source:                  fmt.Sprintf("WHOIS (%s)", result.Host),
+		Source:                  fmt.Sprintf("WHOIS (%s)", host),
 		Domain:                  domain,
-		Registrar:               parsedRegistryWhois.Registrar.Name,
+		Registrar:               registrar,
+		RegistrarIanaId:         registrarIanaId,
 		RegistrantName:          registrantName,
+		RegistrantPrivacy:       privacy,
+		PrivacyService:          privacyService,
 		Statuses:                parsedWhois.Domain.Status,
 		Nameservers:             parsedWhois.Domain.NameServers,
 		CreateDate:              parsedWhois.Domain.CreatedDateInTime,
 		UpdateDate:              parsedWhois.Domain.UpdatedDateInTime,
-		RegistryExpirationDate:  parsedRegistryWhois.Domain.ExpirationDateInTime,
+		RegistryExpirationDate:  registryExpirationDate,
 		RegistrarExpirationDate: registrarExpirationDate,
 		Dnssec:                  parsedWhois.Domain.DNSSec,
+		WhoisChain:              l.chain,
+		TimedOut:                l.timedOut,
+		Raw:                     l.raw,
 	}, nil
 }
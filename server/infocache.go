@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultInfoCacheSize                 = 10000
+	defaultInfoCacheTtl                  = 5 * time.Minute
+	defaultInfoCacheStaleWhileRevalidate = time.Hour
+)
+
+type infoCacheKey struct {
+	domain        string
+	lookupType    LookupType
+	source        LookupSource
+	precedence    string
+	includeRaw    bool
+	privateSuffix PrivateSuffixMode
+}
+
+func newInfoCacheKey(domain string, opts InfoOptions) infoCacheKey {
+	precedence := make([]string, len(opts.Precedence))
+	for i, source := range opts.Precedence {
+		precedence[i] = string(source)
+	}
+
+	return infoCacheKey{
+		domain:        domain,
+		lookupType:    opts.Type,
+		source:        opts.Source,
+		precedence:    strings.Join(precedence, ","),
+		includeRaw:    opts.IncludeRaw,
+		privateSuffix: opts.PrivateSuffix,
+	}
+}
+
+func (k infoCacheKey) String() string {
+	return fmt.Sprintf("%s/%d/%d/%s/%t/%d", k.domain, k.lookupType, k.source, k.precedence, k.includeRaw, k.privateSuffix)
+}
+
+// CachedInfo is a GetInfo result and when it was fetched.
+type CachedInfo struct {
+	Info    DomainInfo
+	ETag    string
+	Fetched time.Time
+}
+
+func newCachedInfo(info DomainInfo, fetched time.Time) (CachedInfo, error) {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return CachedInfo{}, err
+	}
+	sum := sha256.Sum256(body)
+
+	return CachedInfo{Info: info, ETag: `"` + hex.EncodeToString(sum[:16]) + `"`, Fetched: fetched}, nil
+}
+
+type infoCacheEntry struct {
+	key        infoCacheKey
+	cached     CachedInfo
+	refreshing bool
+}
+
+// InfoCache keeps recent GetInfo results so repeat lookups don't go back to the registry and registrar. Results
+// are fresh for ttl, then served for up to staleWhileRevalidate more while they're refreshed in the background.
+// Partial results, where a stage timed out, aren't kept.
+type InfoCache struct {
+	size                 int
+	ttl                  time.Duration
+	staleWhileRevalidate time.Duration
+
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[infoCacheKey]*list.Element
+	// lru has the most recently used entry at the front
+	lru *list.List
+}
+
+// infoCache is used by /info. A nil cache fetches every time.
+var infoCache *InfoCache
+
+func NewInfoCache(size int, ttl time.Duration, staleWhileRevalidate time.Duration) *InfoCache {
+	return &InfoCache{
+		size:                 size,
+		ttl:                  ttl,
+		staleWhileRevalidate: staleWhileRevalidate,
+		entries:              make(map[infoCacheKey]*list.Element),
+		lru:                  list.New(),
+	}
+}
+
+// infoCacheFromConfig returns nil if the cache is turned off.
+func infoCacheFromConfig(c CacheConfig) *InfoCache {
+	if c.Size == 0 || c.Ttl == 0 {
+		return nil
+	}
+	return NewInfoCache(c.Size, c.Ttl, c.StaleWhileRevalidate)
+}
+
+// Get returns the info for domain and opts, calling fetch if it isn't cached or bypass is set. fetch gets ctx's
+// deadline but not its cancellation, since its result is shared with everyone else asking and kept for later.
+func (c *InfoCache) Get(ctx context.Context, domain string, opts InfoOptions, bypass bool, fetch func(context.Context) (DomainInfo, error)) (CachedInfo, error) {
+	if c == nil {
+		info, err := fetch(ctx)
+		if err != nil {
+			return CachedInfo{}, err
+		}
+		return newCachedInfo(info, time.Now())
+	}
+
+	key := newInfoCacheKey(domain, opts)
+	if bypass {
+		infoCacheLookups.WithLabelValues("bypass").Inc()
+		return c.load(ctx, key, fetch)
+	}
+
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	var cached CachedInfo
+	refresh := false
+	if ok {
+		entry := elem.Value.(*infoCacheEntry)
+		cached = entry.cached
+		age := time.Since(cached.Fetched)
+		switch {
+		case age < c.ttl:
+			c.lru.MoveToFront(elem)
+		case age < c.ttl+c.staleWhileRevalidate:
+			c.lru.MoveToFront(elem)
+			refresh = !entry.refreshing
+			entry.refreshing = true
+		default:
+			ok = false
+		}
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		infoCacheLookups.WithLabelValues("miss").Inc()
+		return c.load(ctx, key, fetch)
+	}
+	if refresh {
+		infoCacheLookups.WithLabelValues("stale").Inc()
+		go c.refresh(ctx, key, fetch)
+	} else {
+		infoCacheLookups.WithLabelValues("hit").Inc()
+	}
+	return cached, nil
+}
+
+// load fetches key, sharing the fetch with anyone else asking for it at the same time. The fetch runs until the
+// deadline of the caller that started it, even if that caller goes away, and then returns whatever stages answered
+// in time. Everyone else stops waiting at their own deadline.
+func (c *InfoCache) load(ctx context.Context, key infoCacheKey, fetch func(context.Context) (DomainInfo, error)) (CachedInfo, error) {
+	var started atomic.Bool
+	ch := c.group.DoChan(key.String(), func() (any, error) {
+		started.Store(true)
+		ctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), requestDeadline(ctx))
+		defer cancel()
+
+		info, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		cached, err := newCachedInfo(info, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, cached)
+		return cached, nil
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-ch:
+	case <-ctx.Done():
+		if !started.Load() || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return CachedInfo{}, fmt.Errorf("gave up waiting for the lookup: %w", ctx.Err())
+		}
+		// Our own fetch is wrapping up its timed out stages at the same deadline, so wait for the partial result
+		result = <-ch
+	}
+	if result.Err != nil {
+		return CachedInfo{}, result.Err
+	}
+	return result.Val.(CachedInfo), nil
+}
+
+// requestDeadline is ctx's deadline, or the longest any request may take if it has none.
+func requestDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(config.Timeouts.MaxRequest)
+}
+
+// refresh reloads key in the background, within the deadline of the request that found it stale.
+func (c *InfoCache) refresh(ctx context.Context, key infoCacheKey, fetch func(context.Context) (DomainInfo, error)) {
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), requestDeadline(ctx))
+	defer cancel()
+
+	cached, err := c.load(ctx, key, fetch)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to refresh cached info", "domain", key.domain, "err", err)
+	}
+	// A partial result isn't kept, so it leaves the stale entry in place just like an error
+	if err != nil || len(cached.Info.TimedOut) > 0 {
+		// Let the next request try again
+		c.mu.Lock()
+		if elem, ok := c.entries[key]; ok {
+			elem.Value.(*infoCacheEntry).refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *InfoCache) put(key infoCacheKey, cached CachedInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(cached.Info.TimedOut) > 0 {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &infoCacheEntry{key: key, cached: cached}
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&infoCacheEntry{key: key, cached: cached})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*infoCacheEntry).key)
+	}
+}
+
+// writeCacheHeaders describes cached to HTTP caches, and reports whether the client already has it according to
+// If-None-Match, in which case it's been sent a 304 and there's nothing left to write.
+func writeCacheHeaders(w http.ResponseWriter, req *http.Request, cached CachedInfo) bool {
+	if len(cached.Info.TimedOut) > 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		return false
+	}
+
+	age := max(time.Since(cached.Fetched), 0)
+	w.Header().Set("ETag", cached.ETag)
+	w.Header().Set("Age", fmt.Sprint(int(age.Seconds())))
+	if infoCache != nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d",
+			int(max(infoCache.ttl-age, 0).Seconds()), int(infoCache.staleWhileRevalidate.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	for _, etag := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if etag == cached.ETag || etag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+type requestIdKey struct{}
+
+func (c LogConfig) handlerOptions() (*slog.HandlerOptions, error) {
+	var level slog.Level
+	if c.Level != "" {
+		if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+			return nil, fmt.Errorf("log: invalid level %q, must be debug, info, warn or error", c.Level)
+		}
+	}
+
+	switch strings.ToLower(c.Format) {
+	case "", "text", "json":
+		return &slog.HandlerOptions{Level: level}, nil
+	default:
+		return nil, fmt.Errorf("log: invalid format %q, must be text or json", c.Format)
+	}
+}
+
+// newLogger builds the server's logger, which writes to stderr.
+func newLogger(c LogConfig) (*slog.Logger, error) {
+	opts, err := c.handlerOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(c.Format) == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+func requestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// loggerFrom returns the default logger, tagged with ctx's request ID if it has one.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if id := requestIdFrom(ctx); id != "" {
+		return slog.Default().With("requestId", id)
+	}
+	return slog.Default()
+}
+
+// validRequestId accepts request IDs from upstream proxies as long as they're short and printable, so they can't
+// be used to forge log lines.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// loggingMiddleware gives every request an ID, which is echoed in the X-Request-Id response header and tagged on
+// everything logged while serving it, then logs the request once it's done. A proxy in front can pass its own ID
+// in the same header.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, id)
+		ctx := withRequestId(req.Context(), id)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+
+		loggerFrom(ctx).Info("request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"query", req.URL.RawQuery,
+			"status", recorder.status,
+			"duration", time.Since(start))
+	})
+}
@@ -1,20 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
 	"net/http"
-	"net/netip"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 )
 
 type ErrorResp struct {
-	Type          string   `json:"type"`
-	ErrorMessages []string `json:"errors"`
+	Type          string    `json:"type"`
+	Code          ErrorCode `json:"code"`
+	ErrorMessages []string  `json:"errors"`
 }
 
 func diJsonEncoder(w http.ResponseWriter) *json.Encoder {
@@ -25,89 +29,98 @@ func diJsonEncoder(w http.ResponseWriter) *json.Encoder {
 	return encoder
 }
 
+func writeError(w http.ResponseWriter, encoder *json.Encoder, err error) {
+	code := ErrorCodeOf(err)
+
+	w.WriteHeader(code.HttpStatus())
+	encodeError := encoder.Encode(ErrorResp{
+		Type:          "error",
+		Code:          code,
+		ErrorMessages: strings.Split(err.Error(), "\n"),
+	})
+
+	if encodeError != nil {
+		slog.Error("failed to encode error, uhhhhhhhhhhhhh", "requestId", w.Header().Get(requestIdHeader), "err", encodeError)
+	}
+}
+
 func domainInfo(w http.ResponseWriter, req *http.Request) {
 	encoder := diJsonEncoder(w)
 
-	domain := mux.Vars(req)["domain"]
-	lookupSource, err := ParseLookupSource(req.URL.Query().Get("source"))
-	if err != nil {
-		fmt.Printf("Error parsing lookup source: %v\n", err)
-	}
-	lookupType, err := ParseLookupType(req.URL.Query().Get("type"))
+	infoReq, err := parseInfoRequest(req)
 	if err != nil {
-		fmt.Printf("Error parsing lookup type: %v\n", err)
+		writeError(w, encoder, err)
+		return
 	}
 
-	info, err := GetInfo(lookupType, domain, lookupSource)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		encodeError := encoder.Encode(ErrorResp{
-			Type:          "error",
-			ErrorMessages: strings.Split(err.Error(), "\n"),
-		})
-
-		if encodeError != nil {
-			fmt.Printf("failed to encode error, uhhhhhhhhhhhhh %s", encodeError)
-		}
+	ctx, cancel := context.WithTimeout(req.Context(), infoReq.Timeout)
+	defer cancel()
 
+	cached, err := lookupInfo(ctx, infoReq)
+	if err != nil {
+		writeError(w, encoder, err)
 		return
 	}
 
-	err = encoder.Encode(info)
+	if writeCacheHeaders(w, req, cached) {
+		return
+	}
+	err = encoder.Encode(cached.Info)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// lookupInfo gets the info for infoReq through the cache, recording it in the history when it's fetched with the
+// default options.
+func lookupInfo(ctx context.Context, infoReq infoRequest) (CachedInfo, error) {
+	return infoCache.Get(ctx, infoReq.Domain, infoReq.Options, infoReq.BypassCache, func(ctx context.Context) (DomainInfo, error) {
+		info, err := GetInfo(ctx, infoReq.Domain, infoReq.Options)
+		if err == nil && store != nil && infoReq.Options.recordsHistory() {
+			if err := store.RecordInfo(info, time.Now()); err != nil {
+				loggerFrom(ctx).Error("failed to record info history", "domain", info.Domain, "err", err)
+			}
+		}
+		return info, err
+	})
+}
+
 func dnsInfo(w http.ResponseWriter, req *http.Request) {
 	encoder := diJsonEncoder(w)
 
-	hostname := mux.Vars(req)["hostname"]
-	ns := req.URL.Query().Get("ns")
-	ip := req.URL.Query().Get("ip")
-	deep, _ := strconv.ParseBool(req.URL.Query().Get("deep"))
-
-	if (ip != "") == (ns != "") {
-		w.WriteHeader(http.StatusInternalServerError)
-		encodeError := encoder.Encode(ErrorResp{
-			Type:          "error",
-			ErrorMessages: []string{"you must provide `ns`es or `ip`s, but not both"},
-		})
-
-		if encodeError != nil {
-			fmt.Printf("failed to encode error, uhhhhhhhhhhhhh %s", encodeError)
-		}
-
+	dnsReq, err := parseDnsRequest(req)
+	if err != nil {
+		writeError(w, encoder, err)
 		return
 	}
 
-	var info map[string][]DnsRecord
-	var err error
-	if ns != "" {
-		info, err = GetDnsRecordsFromNs(hostname, strings.Split(ns, ","), deep)
-	} else if ip != "" {
-		var ips []netip.Addr
-		for _, ip := range strings.Split(ip, ",") {
-			ips = append(ips, netip.MustParseAddr(ip))
-		}
+	ctx, cancel := context.WithTimeout(req.Context(), dnsReq.Timeout)
+	defer cancel()
 
-		info, err = GetDnsRecordsFromIp(hostname, ips, deep)
+	var info map[string][]DnsRecord
+	var timedOut []string
+	if len(dnsReq.Nameservers) > 0 {
+		info, timedOut, err = GetDnsRecordsFromNs(ctx, dnsReq.Hostname, dnsReq.Nameservers, dnsReq.Deep)
+	} else {
+		info, timedOut, err = GetDnsRecordsFromIp(ctx, dnsReq.Hostname, dnsReq.Ips, dnsReq.Deep)
 	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		encodeError := encoder.Encode(ErrorResp{
-			Type:          "error",
-			ErrorMessages: strings.Split(err.Error(), "\n"),
-		})
-
-		if encodeError != nil {
-			fmt.Printf("failed to encode error, uhhhhhhhhhhhhh %s", encodeError)
-		}
-
+		writeError(w, encoder, err)
 		return
 	}
 
+	// The body is keyed by server, so the servers that didn't answer in time are reported out of band
+	if len(timedOut) > 0 {
+		w.Header().Set("X-Timed-Out", string(StageDns)+" "+strings.Join(timedOut, ","))
+	}
+
+	if store != nil {
+		if err := store.RecordDns(dnsReq.Hostname, info, time.Now()); err != nil {
+			loggerFrom(ctx).Error("failed to record DNS history", "hostname", dnsReq.Hostname, "err", err)
+		}
+	}
+
 	// Encode the data to JSON and write it to the response
 	err = encoder.Encode(info)
 	if err != nil {
@@ -117,22 +130,101 @@ func dnsInfo(w http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
+	var err error
+	config, err = loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+		os.Exit(2)
+	}
+
+	logger, err := newLogger(config.Log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error configuring logging: %s\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := setupTracing(context.Background(), config.Tracing)
+	if err != nil {
+		slog.Error("error configuring tracing", "err", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("failed to flush traces", "err", err)
+		}
+	}()
+
+	sourcePool = sourcePoolFromConfig(config)
+	rateLimiter = rateLimiterFromConfig(config)
+	infoCache = infoCacheFromConfig(config.Cache)
+
+	rdapBootstrap := rdapBootstrapFromConfig(config.Rdap)
+	go rdapBootstrap.Run(context.Background())
+	rdapClient = NewRdapClient(rdapBootstrap)
+
+	registrarDirectory = registrarDirectoryFromConfig(config.Registrars)
+	go registrarDirectory.Run(context.Background())
+
+	store, err = OpenStore(config.DbPath)
+	if err != nil {
+		slog.Error("error opening store", "path", config.DbPath, "err", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	go store.RunPruning(context.Background(), config.Retention)
+
+	scheduler = NewScheduler(store, config.Watch.Concurrency, config.Watch.Jitter)
+
+	if sinks := alertSinks(config.Alerts); len(sinks) > 0 {
+		scheduler.OnRun(NewAlerter(store, sinks).observe)
+	}
+
+	dispatcher := dispatcherFromConfig(context.Background(), store, config.Events)
+	if dispatcher != nil {
+		if err := dispatcher.Resume(); err != nil {
+			slog.Error("failed to resume event deliveries", "err", err)
+		}
+		scheduler.OnRun(dispatcher.observe)
+	}
+	go scheduler.Run(context.Background())
+
 	r := mux.NewRouter()
+	r.Use(metricsMiddleware, tracingMiddleware)
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	r.HandleFunc("/info/{domain}", domainInfo).Methods("GET")
 	r.HandleFunc("/dns/{hostname}", dnsInfo).Methods("GET")
+	r.HandleFunc("/history/{domain}", historyInfo).Methods("GET")
+	r.HandleFunc("/diff/{domain}", historyDiff).Methods("GET")
+	r.HandleFunc("/registrar/{ianaId}", registrarInfo).Methods("GET")
+	r.HandleFunc("/tld/{tld}", tldInfo).Methods("GET")
+	r.HandleFunc("/transfer-readiness/{domain}", transferReadiness).Methods("GET")
+	r.HandleFunc("/ds/{domain}", dsInfo).Methods("GET")
+	r.HandleFunc("/watchlist", listWatches).Methods("GET")
+	r.HandleFunc("/watchlist", createWatch).Methods("POST")
+	r.HandleFunc("/watchlist/{id}", getWatch).Methods("GET")
+	r.HandleFunc("/watchlist/{id}", updateWatch).Methods("PUT")
+	r.HandleFunc("/watchlist/{id}", deleteWatch).Methods("DELETE")
+	r.HandleFunc("/watchlist/{id}/results", listWatchRuns).Methods("GET")
+	r.HandleFunc("/watchlist/{id}/deliveries", listDeliveries).Methods("GET")
 
-	addr := ":3333"
 	srv := &http.Server{
-		Handler: r,
-		Addr:    addr,
+		Handler: loggingMiddleware(r),
+		Addr:    config.Listen,
 	}
 
-	fmt.Printf("Listening on %s", addr)
-	err := srv.ListenAndServe()
+	slog.Info("listening", "addr", config.Listen, "tls", config.Tls.enabled())
+	if config.Tls.enabled() {
+		err = srv.ListenAndServeTLS(config.Tls.CertFile, config.Tls.KeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if errors.Is(err, http.ErrServerClosed) {
-		fmt.Printf("server closed\n")
+		slog.Info("server closed")
 	} else if err != nil {
-		fmt.Printf("error starting server: %s\n", err)
+		slog.Error("error starting server", "err", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfoSource is one of the four places a merged lookup can take a field from.
+type InfoSource string
+
+const (
+	sourceRegistryRdap   InfoSource = "registry-rdap"
+	sourceRegistrarRdap  InfoSource = "registrar-rdap"
+	sourceRegistryWhois  InfoSource = "registry-whois"
+	sourceRegistrarWhois InfoSource = "registrar-whois"
+)
+
+// defaultMergePrecedence mirrors what auto lookups do: registrar data beats registry data, and RDAP beats WHOIS.
+var defaultMergePrecedence = []InfoSource{
+	sourceRegistrarRdap,
+	sourceRegistryRdap,
+	sourceRegistrarWhois,
+	sourceRegistryWhois,
+}
+
+// infoLookup is a fetched rdapLookup or whoisLookup.
+type infoLookup interface {
+	info(domain string) (DomainInfo, error)
+}
+
+// FieldConflict records a field that two or more sources disagreed on, and what each of them said.
+type FieldConflict struct {
+	Field  string             `json:"field"`
+	Values map[InfoSource]any `json:"values"`
+}
+
+// ParseMergePrecedence parses a comma-separated list of sources. Sources that aren't mentioned keep their default
+// relative order after the ones that are, so "registry-whois" alone just moves that source to the front.
+func ParseMergePrecedence(s string) ([]InfoSource, error) {
+	var precedence []InfoSource
+	for _, item := range splitList(strings.ToLower(s)) {
+		source := InfoSource(item)
+		if !slices.Contains(defaultMergePrecedence, source) {
+			return nil, fmt.Errorf("%q is not a valid source", item)
+		}
+		if slices.Contains(precedence, source) {
+			return nil, fmt.Errorf("%q is listed more than once", item)
+		}
+		precedence = append(precedence, source)
+	}
+
+	for _, source := range defaultMergePrecedence {
+		if !slices.Contains(precedence, source) {
+			precedence = append(precedence, source)
+		}
+	}
+
+	return precedence, nil
+}
+
+// getMergedInfo asks RDAP and WHOIS at the same time and builds a DomainInfo field by field from whichever sources
+// answered, preferring them in the given order.
+func getMergedInfo(ctx context.Context, domain string, lookupSource LookupSource, precedence []InfoSource) (DomainInfo, error) {
+	var wg sync.WaitGroup
+	var rdapRes rdapLookup
+	var whoisRes whoisLookup
+	var rdapErr, whoisErr error
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		rdapRes, rdapErr = fetchRdap(ctx, domain, lookupSource)
+	}()
+	go func() {
+		defer wg.Done()
+		whoisRes, whoisErr = fetchWhois(ctx, domain, lookupSource)
+	}()
+	wg.Wait()
+
+	var timedOut []Stage
+	lookups := make(map[InfoSource]infoLookup)
+	if rdapErr == nil {
+		timedOut = append(timedOut, rdapRes.timedOut...)
+		lookups[sourceRegistryRdap] = rdapLookup{registry: rdapRes.registry, registryUrl: rdapRes.registryUrl}
+		if rdapRes.registrar != nil {
+			lookups[sourceRegistrarRdap] = rdapLookup{registrar: rdapRes.registrar, registrarUrl: rdapRes.registrarUrl}
+		}
+	} else if isTimeout(rdapErr) {
+		timedOut = append(timedOut, StageRegistry)
+	}
+	if whoisErr == nil {
+		timedOut = append(timedOut, whoisRes.timedOut...)
+		// raw goes along so registrarIanaId can find an explicit IANA ID line in each response
+		lookups[sourceRegistryWhois] = whoisLookup{registry: whoisRes.registry, registryHost: whoisRes.registryHost, raw: whoisRes.raw}
+		if whoisRes.registrar != nil {
+			lookups[sourceRegistrarWhois] = whoisLookup{registrar: whoisRes.registrar, registrarHost: whoisRes.registrarHost, raw: whoisRes.raw}
+		}
+	} else if isTimeout(whoisErr) {
+		timedOut = append(timedOut, StageWhois)
+	}
+
+	views := make(map[InfoSource]DomainInfo)
+	var errs []error
+	for source, lookup := range lookups {
+		if lookupSource == lookupSourceRegistry && (source == sourceRegistrarRdap || source == sourceRegistrarWhois) ||
+			lookupSource == lookupSourceRegistrar && (source == sourceRegistryRdap || source == sourceRegistryWhois) {
+			continue
+		}
+
+		view, err := lookup.info(domain)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		views[source] = view
+	}
+
+	if len(views) == 0 {
+		return DomainInfo{}, errors.Join(slices.Concat([]error{rdapErr, whoisErr}, errs)...)
+	}
+
+	info := mergeInfo(views, precedence)
+	info.Domain = domain
+	info.TimedOut = timedOut
+	info.WhoisChain = whoisRes.chain
+	info.Raw = slices.Concat(rdapRes.raw, whoisRes.raw)
+	return info, nil
+}
+
+type merger struct {
+	views      map[InfoSource]DomainInfo
+	precedence []InfoSource
+	result     DomainInfo
+}
+
+// mergeField sets a field on the result from the first source in precedence order that has a value for it, and
+// records a conflict if any of the others disagree.
+func mergeField[T any](m *merger, field string, get func(DomainInfo) (T, bool), set func(*DomainInfo, T), equal func(a, b T) bool) {
+	var chosen InfoSource
+	var value T
+	values := make(map[InfoSource]any)
+	conflict := false
+
+	for _, source := range m.precedence {
+		view, ok := m.views[source]
+		if !ok {
+			continue
+		}
+		v, ok := get(view)
+		if !ok {
+			continue
+		}
+
+		values[source] = v
+		if chosen == "" {
+			chosen, value = source, v
+		} else if !equal(value, v) {
+			conflict = true
+		}
+	}
+
+	if chosen == "" {
+		return
+	}
+
+	set(&m.result, value)
+	m.result.Provenance[field] = chosen
+	if conflict {
+		m.result.Conflicts = append(m.result.Conflicts, FieldConflict{Field: field, Values: values})
+	}
+}
+
+func mergeInfo(views map[InfoSource]DomainInfo, precedence []InfoSource) DomainInfo {
+	m := &merger{
+		views:      views,
+		precedence: precedence,
+		result: DomainInfo{
+			Provenance: make(map[string]InfoSource),
+			Sources:    make(map[InfoSource]string),
+		},
+	}
+
+	var used []string
+	for _, source := range precedence {
+		if view, ok := views[source]; ok {
+			m.result.Sources[source] = view.Source
+			used = append(used, string(source))
+		}
+	}
+	m.result.Source = fmt.Sprintf("Merged (%s)", strings.Join(used, ", "))
+
+	mergeField(m, "registrar",
+		func(i DomainInfo) (string, bool) { return i.Registrar, registrarName(i.Registrar) != "" },
+		func(i *DomainInfo, v string) { i.Registrar = v },
+		func(a, b string) bool { return strings.EqualFold(registrarName(a), registrarName(b)) })
+	mergeField(m, "registrarIanaId",
+		func(i DomainInfo) (int, bool) { return i.RegistrarIanaId, i.RegistrarIanaId > 0 },
+		func(i *DomainInfo, v int) { i.RegistrarIanaId = v },
+		func(a, b int) bool { return a == b })
+	mergeField(m, "statuses",
+		func(i DomainInfo) ([]string, bool) { return i.Statuses, len(i.Statuses) > 0 },
+		func(i *DomainInfo, v []string) { i.Statuses = v },
+		sameNormalized(normalizeStatus))
+	mergeField(m, "nameservers",
+		func(i DomainInfo) ([]string, bool) { return i.Nameservers, len(i.Nameservers) > 0 },
+		func(i *DomainInfo, v []string) { i.Nameservers = v },
+		sameNormalized(normalizeNameserver))
+	mergeField(m, "createDate",
+		func(i DomainInfo) (*time.Time, bool) { return i.CreateDate, i.CreateDate != nil },
+		func(i *DomainInfo, v *time.Time) { i.CreateDate = v },
+		sameDay)
+	mergeField(m, "updateDate",
+		func(i DomainInfo) (*time.Time, bool) { return i.UpdateDate, i.UpdateDate != nil },
+		func(i *DomainInfo, v *time.Time) { i.UpdateDate = v },
+		sameDay)
+	mergeField(m, "registryExpirationDate",
+		func(i DomainInfo) (*time.Time, bool) {
+			return i.RegistryExpirationDate, i.RegistryExpirationDate != nil
+		},
+		func(i *DomainInfo, v *time.Time) { i.RegistryExpirationDate = v },
+		sameDay)
+	mergeField(m, "registrarExpirationDate",
+		func(i DomainInfo) (*time.Time, bool) {
+			return i.RegistrarExpirationDate, i.RegistrarExpirationDate != nil
+		},
+		func(i *DomainInfo, v *time.Time) { i.RegistrarExpirationDate = v },
+		sameDay)
+	mergeField(m, "registrantName",
+		func(i DomainInfo) (*string, bool) { return i.RegistrantName, i.RegistrantName != nil },
+		func(i *DomainInfo, v *string) { i.RegistrantName = v },
+		func(a, b *string) bool { return strings.EqualFold(strings.TrimSpace(*a), strings.TrimSpace(*b)) })
+	if source, ok := m.result.Provenance["registrantName"]; ok {
+		// A source that names the registrant trumps one that doesn't
+		m.result.RegistrantPrivacy = views[source].RegistrantPrivacy
+		m.result.Provenance["registrantPrivacy"] = source
+	} else {
+		mergeField(m, "registrantPrivacy",
+			func(i DomainInfo) (RegistrantPrivacy, bool) { return i.RegistrantPrivacy, i.RegistrantPrivacy != "" },
+			func(i *DomainInfo, v RegistrantPrivacy) { i.RegistrantPrivacy = v },
+			func(a, b RegistrantPrivacy) bool { return a == b })
+		if source, ok := m.result.Provenance["registrantPrivacy"]; ok {
+			m.result.PrivacyService = views[source].PrivacyService
+		}
+	}
+	mergeField(m, "dnssec",
+		func(i DomainInfo) (bool, bool) { return i.Dnssec, true },
+		func(i *DomainInfo, v bool) { i.Dnssec = v },
+		func(a, b bool) bool { return a == b })
+	mergeField(m, "dsData",
+		func(i DomainInfo) ([]DsRecord, bool) { return i.DsData, len(i.DsData) > 0 },
+		func(i *DomainInfo, v []DsRecord) { i.DsData = v },
+		sameDsRecords)
+
+	return m.result
+}
+
+var ianaSuffixRegex = regexp.MustCompile(`\s*\(IANA \d+\)$`)
+
+// registrarName strips the " (IANA 123)" suffix RDAP lookups add, so RDAP and WHOIS registrars can be compared.
+func registrarName(registrar string) string {
+	return strings.TrimSpace(ianaSuffixRegex.ReplaceAllString(registrar, ""))
+}
+
+// normalizeStatus turns both RDAP ("client transfer prohibited") and WHOIS ("clientTransferProhibited
+// https://icann.org/epp#clientTransferProhibited") statuses into "clienttransferprohibited".
+func normalizeStatus(status string) string {
+	if i := strings.Index(status, "http"); i >= 0 {
+		status = status[:i]
+	}
+	return strings.ToLower(strings.Join(strings.Fields(status), ""))
+}
+
+func normalizeNameserver(ns string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(ns)), ".")
+}
+
+// sameNormalized compares two lists as sets after normalizing each item.
+func sameNormalized(normalize func(string) string) func(a, b []string) bool {
+	return func(a, b []string) bool {
+		setA := make([]string, 0, len(a))
+		for _, item := range a {
+			setA = append(setA, normalize(item))
+		}
+		setB := make([]string, 0, len(b))
+		for _, item := range b {
+			setB = append(setB, normalize(item))
+		}
+		slices.Sort(setA)
+		slices.Sort(setB)
+		return slices.Equal(slices.Compact(setA), slices.Compact(setB))
+	}
+}
+
+// sameDay treats two dates as the same if they're less than a day apart, since registries and registrars routinely
+// disagree on the time of day and time zone of the same event.
+func sameDay(a, b *time.Time) bool {
+	return a.Sub(*b).Abs() < 24*time.Hour
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+)
+
+const metricsNamespace = "domain_info"
+
+// Upstreams are the kinds of server we query, for labelling metrics.
+const (
+	upstreamRdap     = "rdap"
+	upstreamWhois    = "whois"
+	upstreamDns      = "dns"
+	upstreamResolver = "resolver"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route and status code.",
+	}, []string{"handler", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by route.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"handler", "method"})
+
+	upstreamQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_queries_total",
+		Help:      "Queries sent to RDAP, WHOIS and DNS servers, by TLD, server and result (ok or an error code).",
+	}, []string{"upstream", "tld", "server", "result"})
+	upstreamQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_query_duration_seconds",
+		Help:      "Time taken by queries to RDAP, WHOIS and DNS servers, by TLD and server.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"upstream", "tld", "server"})
+
+	infoCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "info_cache_lookups_total",
+		Help:      "/info cache lookups, by result: hit, stale (served while refreshing), miss or bypass.",
+	}, []string{"result"})
+
+	resolverCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "resolver_cache_lookups_total",
+		Help:      "Resolver query cache lookups, by whether they hit. Each request has its own cache, so hits are repeat queries within a request.",
+	}, []string{"result"})
+
+	rateLimitWaits = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_wait_seconds",
+		Help:      "Time queries spent queued behind an upstream's rate limit, by upstream.",
+		Buckets:   []float64{0, .01, .1, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"upstream"})
+
+	sourceCooldowns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "source_cooldowns_total",
+		Help:      "Times a source address was rate limited by an upstream and put to rest, by address.",
+	}, []string{"source"})
+
+	fallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fallbacks_total",
+		Help:      "Lookups that fell back from one source to another, like RDAP to WHOIS or registrar to registry.",
+	}, []string{"from", "to"})
+)
+
+// tldOf is the label for the TLD of name.
+func tldOf(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// observeUpstream records a query to server that started at start and finished with err.
+func observeUpstream(upstream string, tld string, server string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = string(ErrorCodeOf(err))
+	}
+	observeUpstreamResult(upstream, tld, server, start, result)
+}
+
+func observeUpstreamResult(upstream string, tld string, server string, start time.Time, result string) {
+	upstreamQueries.WithLabelValues(upstream, tld, server, result).Inc()
+	upstreamQueryDuration.WithLabelValues(upstream, tld, server).Observe(time.Since(start).Seconds())
+}
+
+func observeFallback(from string, to string) {
+	fallbacks.WithLabelValues(from, to).Inc()
+}
+
+// httpStatusResult maps an upstream HTTP status to the same results observeUpstream uses for errors.
+func httpStatusResult(status int) string {
+	switch {
+	case status < 400:
+		return "ok"
+	case status == http.StatusNotFound:
+		return string(ErrCodeNotFound)
+	case status == http.StatusTooManyRequests:
+		return string(ErrCodeRateLimited)
+	case status == http.StatusBadRequest:
+		return string(ErrCodeInvalidInput)
+	default:
+		return string(ErrCodeInternal)
+	}
+}
+
+// instrumentedTransport rate limits, records and traces every request an RDAP client makes, including redirects, and
+// backs off from servers that rate limit us anyway.
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tld := rdapTldFrom(req.Context())
+	if err := rateLimiter.Wait(req.Context(), upstreamRdap, req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	ctx, span := startUpstreamSpan(req.Context(), upstreamRdap, req.URL.Host,
+		semconv.HTTPRequestMethodKey.String(req.Method), semconv.URLFull(req.URL.String()))
+
+	queryCtx, cancelQuery := upstreamContext(ctx, req.URL.Hostname())
+	var local net.Addr
+	queryCtx = httptrace.WithClientTrace(queryCtx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { local = info.Conn.LocalAddr() },
+	})
+	resp, err := t.base.RoundTrip(req.WithContext(queryCtx))
+	if err != nil {
+		cancelQuery()
+		endSpan(span, err)
+		observeUpstream(upstreamRdap, tld, req.URL.Host, start, err)
+	} else {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+		cancel := cancelQuery
+		if resp.StatusCode == http.StatusTooManyRequests {
+			sourcePool.CoolDown(req.URL.Hostname(), local)
+			rateLimiter.Backoff(upstreamRdap, req.URL.Hostname())
+			// Don't keep reusing the connection from the address that's cooling down
+			if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+				cancel = func() {
+					cancelQuery()
+					closer.CloseIdleConnections()
+				}
+			}
+		}
+		span.End()
+		// The body is still to be read, so the query isn't over until it's closed
+		resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		observeUpstreamResult(upstreamRdap, tld, req.URL.Host, start, httpStatusResult(resp.StatusCode))
+	}
+	return resp, err
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware counts and times requests by route template, so /info/{domain} is one series rather than one
+// per domain.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler := "unknown"
+		if route := mux.CurrentRoute(req); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				handler = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		httpRequests.WithLabelValues(handler, req.Method, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(handler, req.Method).Observe(time.Since(start).Seconds())
+	})
+}
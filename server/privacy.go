@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/openrdap/rdap"
+)
+
+// RegistrantPrivacy is how much a registry or registrar publishes about who holds a domain.
+type RegistrantPrivacy string
+
+const (
+	// privacyRedacted means the registrant isn't published, or only as a placeholder like "REDACTED FOR PRIVACY".
+	privacyRedacted RegistrantPrivacy = "redacted"
+	// privacyProxy means a privacy service is registered in the registrant's place.
+	privacyProxy RegistrantPrivacy = "proxy"
+	// privacyPublic means the registrant's name or organization is published.
+	privacyPublic RegistrantPrivacy = "public"
+	// privacyPrivateSuffix means the name was handed out under a private suffix, like github.io, so the registrant
+	// of the domain it was looked up as only runs the platform. See withPublicSuffix.
+	privacyPrivateSuffix RegistrantPrivacy = "private-suffix"
+)
+
+// privacyService is a proxy service, recognized by any of patterns appearing in the registrant's name or
+// organization.
+type privacyService struct {
+	name     string
+	patterns []string
+}
+
+// privacyServices are the proxy services registrars use most, by how they appear in registrant contacts. Patterns
+// are lowercase.
+var privacyServices = []privacyService{
+	{"Domains By Proxy, LLC", []string{"domains by proxy", "domainsbyproxy.com"}},
+	{"Withheld for Privacy ehf", []string{"withheld for privacy"}},
+	{"Contact Privacy Inc.", []string{"contact privacy inc", "contactprivacy.com"}},
+	{"PrivacyGuardian.org llc", []string{"privacyguardian"}},
+	{"WhoisGuard, Inc.", []string{"whoisguard"}},
+	{"Perfect Privacy, LLC", []string{"perfect privacy"}},
+	{"Domain Protection Services, Inc.", []string{"domain protection services"}},
+	{"Whois Privacy Protection Service, Inc.", []string{"whois privacy protection service"}},
+	{"Privacy Protect, LLC", []string{"privacy protect, llc", "privacyprotect.org"}},
+	{"Super Privacy Service LTD", []string{"super privacy service"}},
+	{"Identity Protection Service", []string{"identity protection service"}},
+	{"Whois Privacy Corp.", []string{"whois privacy corp"}},
+	{"Domain Privacy Service FBO Registrant", []string{"domain privacy service fbo registrant"}},
+	{"Private by Design, LLC", []string{"private by design"}},
+	{"Proxy Protection LLC", []string{"proxy protection llc"}},
+	{"Above.com Domain Privacy", []string{"above.com domain privacy"}},
+	{"1337 Services LLC", []string{"1337 services llc"}},
+}
+
+// redactionPlaceholders appear in place of a registrant's name when it's been withheld. Patterns are lowercase.
+var redactionPlaceholders = []string{
+	"redacted",
+	"withheld",
+	"not disclosed",
+	"undisclosed",
+	"non-public data",
+	"data protected",
+	"gdpr masked",
+	"statutory masking",
+	"hidden upon user request",
+	"private person",
+}
+
+// placeholderNames are whole values that stand in for a name without saying anything.
+var placeholderNames = []string{"", "-", "n/a", "na", "none", "null", "registrant", "private"}
+
+// classifyRegistrant works out how public the registrant is from what was published as their name, organization,
+// and so on, most preferred first. name is the first candidate that's real, if the registrant is public, and
+// service names the proxy if they're behind one.
+func classifyRegistrant(candidates ...string) (privacy RegistrantPrivacy, name *string, service *string) {
+	for _, candidate := range candidates {
+		lower := strings.ToLower(candidate)
+		for _, s := range privacyServices {
+			for _, pattern := range s.patterns {
+				if strings.Contains(lower, pattern) {
+					return privacyProxy, nil, &s.name
+				}
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if !isRedactionPlaceholder(candidate) {
+			name := strings.TrimSpace(candidate)
+			return privacyPublic, &name, nil
+		}
+	}
+	return privacyRedacted, nil, nil
+}
+
+func isRedactionPlaceholder(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, placeholder := range placeholderNames {
+		if s == placeholder {
+			return true
+		}
+	}
+	for _, placeholder := range redactionPlaceholders {
+		if strings.Contains(s, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// rdapRedactedFields are the fields a domain's RFC 9537 "redacted" member says were redacted, lowercased, like
+// "registrant name". Servers can replace a redacted value with anything, so the value can't be trusted even if it
+// doesn't look like a placeholder.
+func rdapRedactedFields(domain *rdap.Domain) map[string]bool {
+	fields := make(map[string]bool)
+	if domain.DecodeData == nil {
+		return fields
+	}
+
+	redacted, _ := domain.DecodeData.Value("redacted").([]any)
+	for _, item := range redacted {
+		entry, _ := item.(map[string]any)
+		name, _ := entry["name"].(map[string]any)
+		for _, key := range []string{"type", "description"} {
+			if field, ok := name[key].(string); ok && field != "" {
+				fields[strings.ToLower(field)] = true
+			}
+		}
+	}
+	return fields
+}
+
+// rdapRegistrantCandidates is what an RDAP domain says the registrant is called, leaving out anything it says was
+// redacted.
+func rdapRegistrantCandidates(domain *rdap.Domain, registrant *rdap.Entity) []string {
+	if registrant == nil || registrant.VCard == nil {
+		return nil
+	}
+
+	redacted := rdapRedactedFields(domain)
+	var candidates []string
+	if !redacted["registrant name"] {
+		candidates = append(candidates, registrant.VCard.Name())
+	}
+	if org := registrant.VCard.GetFirst("org"); org != nil && len(org.Values()) > 0 && !redacted["registrant organization"] {
+		candidates = append(candidates, org.Values()[0])
+	}
+	return candidates
+}
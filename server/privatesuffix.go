@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// PublicSuffixInfo is how the Public Suffix List reads a name. It can disagree with the domain a lookup is made for:
+// that comes from zonedb, which only knows the suffixes registries sell under, so "foo.github.io" is looked up as
+// "github.io", where the PSL knows github.io is a suffix GitHub hands out names under.
+type PublicSuffixInfo struct {
+	// Suffix is the public suffix the name is under, like "com", "co.uk" or "github.io".
+	Suffix string `json:"suffix"`
+	// Private is true for suffixes in the PSL's private section, which a company runs for its customers rather than a
+	// registry for registrants.
+	Private bool `json:"private"`
+	// RegistrableDomain is the suffix and the label before it, if the name is under the suffix rather than the
+	// suffix itself.
+	RegistrableDomain string `json:"registrableDomain,omitempty"`
+	// Operator runs a private suffix, if we know who they are.
+	Operator *string `json:"operator,omitempty"`
+}
+
+// privateSuffixOperators are who runs the private suffixes names are most often asked about. The PSL names them in
+// comments, which aren't in the compiled list, so they're kept here. Keyed like matchSuffix, so "amazonaws.com" covers
+// the many suffixes under it.
+var privateSuffixOperators = map[string]string{
+	"amazonaws.com":         "Amazon Web Services, Inc.",
+	"cloudfront.net":        "Amazon Web Services, Inc.",
+	"appspot.com":           "Google LLC",
+	"blogspot.com":          "Google LLC",
+	"firebaseapp.com":       "Google LLC",
+	"web.app":               "Google LLC",
+	"github.io":             "GitHub, Inc.",
+	"githubusercontent.com": "GitHub, Inc.",
+	"gitlab.io":             "GitLab Inc.",
+	"herokuapp.com":         "Salesforce, Inc. (Heroku)",
+	"netlify.app":           "Netlify, Inc.",
+	"vercel.app":            "Vercel Inc.",
+	"pages.dev":             "Cloudflare, Inc.",
+	"workers.dev":           "Cloudflare, Inc.",
+	"azurewebsites.net":     "Microsoft Corporation",
+	"cloudapp.net":          "Microsoft Corporation",
+	"myshopify.com":         "Shopify Inc.",
+	"fly.dev":               "Fly.io, Inc.",
+	"onrender.com":          "Render Services, Inc.",
+	"glitch.me":             "Fastly, Inc. (Glitch)",
+	"neocities.org":         "Neocities",
+	"dyndns.org":            "Oracle Corporation (Dyn)",
+	"no-ip.org":             "Vitalwerks Internet Solutions, LLC (No-IP)",
+}
+
+// publicSuffixOf reads name, which must be in A-label form, against the PSL.
+func publicSuffixOf(name string) PublicSuffixInfo {
+	suffix, icann := publicsuffix.PublicSuffix(name)
+	info := PublicSuffixInfo{
+		Suffix: suffix,
+		// Names under a TLD the PSL doesn't list get the TLD as their suffix, outside the ICANN section, but aren't
+		// under a private suffix
+		Private: !icann && strings.Contains(suffix, "."),
+	}
+	if registrable, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		info.RegistrableDomain = registrable
+	}
+
+	if info.Private {
+		operator, ok := matchSuffix(config.PrivateSuffixes, suffix)
+		if !ok {
+			operator, ok = matchSuffix(privateSuffixOperators, suffix)
+		}
+		if ok {
+			info.Operator = &operator
+		}
+	}
+	return info
+}
+
+// PrivateSuffixMode is what a lookup reports about a name under a private suffix.
+type PrivateSuffixMode uint8
+
+const (
+	// privateSuffixRegistrable reports the domain the name was looked up as, registrant and all.
+	privateSuffixRegistrable PrivateSuffixMode = iota
+	// privateSuffixOperator reports the private suffix's operator in place of the registrant, since they're the
+	// platform the name was handed out by, not who holds it.
+	privateSuffixOperator
+)
+
+var (
+	PrivateSuffixModeValue = map[string]PrivateSuffixMode{
+		"":            privateSuffixRegistrable,
+		"registrable": privateSuffixRegistrable,
+		"operator":    privateSuffixOperator,
+	}
+)
+
+func ParsePrivateSuffixMode(s string) (PrivateSuffixMode, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	value, ok := PrivateSuffixModeValue[s]
+	if !ok {
+		return privateSuffixRegistrable, fmt.Errorf("%q is not a valid private suffix mode", s)
+	}
+	return value, nil
+}
+
+// withPublicSuffix records the name that was asked about and how the PSL reads it. In privateSuffixOperator mode a
+// name under a private suffix has its registrant cleared, since whoever registered the domain the lookup was made
+// for only runs the platform.
+func withPublicSuffix(info DomainInfo, query string, mode PrivateSuffixMode) DomainInfo {
+	info.Query = query
+	info.PublicSuffix = publicSuffixOf(query)
+
+	if mode == privateSuffixOperator && info.PublicSuffix.Private && query != info.PublicSuffix.Suffix {
+		info.RegistrantName = nil
+		info.RegistrantPrivacy = privacyPrivateSuffix
+		info.PrivacyService = nil
+		delete(info.Provenance, "registrantName")
+		delete(info.Provenance, "registrantPrivacy")
+	}
+	return info
+}
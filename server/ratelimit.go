@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket: Rate queries a second on average, in bursts of up to Burst.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Rate <= 0 || l.Burst < 1 {
+		return errors.New("rate must be greater than 0 and burst at least 1")
+	}
+	return nil
+}
+
+// defaultRateLimits are per host, by kind of upstream. WHOIS servers are by far the touchiest.
+var defaultRateLimits = map[string]RateLimit{
+	upstreamRdap:     {Rate: 5, Burst: 10},
+	upstreamWhois:    {Rate: 1, Burst: 3},
+	upstreamDns:      {Rate: 20, Burst: 40},
+	upstreamResolver: {Rate: 20, Burst: 40},
+}
+
+const defaultRateLimitBackoff = time.Minute
+
+// maxIdleRateLimiters is how many limiters are kept before idle ones are dropped. The resolver touches a nameserver
+// for every zone it walks through, so without a cap there'd be one for every nameserver we've ever asked.
+const maxIdleRateLimiters = 10000
+
+// whoisLimitPhrases are what WHOIS servers say instead of answering when we've queried them too much.
+var whoisLimitPhrases = []string{
+	"limit exceeded",
+	"quota exceeded",
+	"too many queries",
+	"too many requests",
+	"excessive queries",
+	"excessive querying",
+	"exceeded the maximum allowable",
+	"exceeded your query limit",
+	"maximum daily connection limit",
+	"maximum query rate",
+	"server too busy",
+	"due to query limit controls",
+	"exceeded your allotted number of",
+}
+
+// maxWhoisLimitResponse is the longest response we'll look for whoisLimitPhrases in. Refusals are short, and real
+// records can have long legal notices that happen to use the same words.
+const maxWhoisLimitResponse = 1024
+
+// whoisRateLimited reports whether body is a WHOIS server refusing to answer because of a query limit.
+func whoisRateLimited(body string) bool {
+	if len(body) > maxWhoisLimitResponse {
+		return false
+	}
+
+	body = strings.ToLower(body)
+	for _, phrase := range whoisLimitPhrases {
+		if strings.Contains(body, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+type hostLimiter struct {
+	*rate.Limiter
+	pausedUntil time.Time
+}
+
+// idle is whether the limiter is no different from a new one: its bucket is full and it isn't backing off.
+func (h *hostLimiter) idle(now time.Time) bool {
+	return !h.pausedUntil.After(now) && h.TokensAt(now) >= float64(h.Burst())
+}
+
+// limiterKey is a host as one kind of upstream. The same nameserver is asked both by /dns and by the resolver, and
+// each gets its own limit.
+type limiterKey struct {
+	upstream string
+	host     string
+}
+
+// RateLimiter keeps us polite to upstreams with a token bucket per host and kind of upstream, so bulk work queues up
+// rather than getting us blocked. A host that says we've hit its limit anyway is left alone for a while.
+type RateLimiter struct {
+	defaults  map[string]RateLimit
+	overrides map[string]RateLimit
+	backoff   time.Duration
+
+	mu       sync.Mutex
+	limiters map[limiterKey]*hostLimiter
+}
+
+// rateLimiter is shared by every lookup. A nil limiter doesn't limit anything.
+var rateLimiter *RateLimiter
+
+func NewRateLimiter(defaults map[string]RateLimit, overrides map[string]RateLimit, backoff time.Duration) *RateLimiter {
+	return &RateLimiter{
+		defaults:  defaults,
+		overrides: overrides,
+		backoff:   backoff,
+		limiters:  make(map[limiterKey]*hostLimiter),
+	}
+}
+
+func rateLimiterFromConfig(c Config) *RateLimiter {
+	overrides := make(map[string]RateLimit)
+	for host, profile := range c.Upstreams {
+		if profile.RateLimit != nil {
+			overrides[host] = *profile.RateLimit
+		}
+	}
+	return NewRateLimiter(c.RateLimits.Defaults, overrides, c.RateLimits.Backoff)
+}
+
+func (l *RateLimiter) limiter(upstream string, host string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := limiterKey{upstream, host}
+	if limiter, ok := l.limiters[key]; ok {
+		return limiter
+	}
+	if len(l.limiters) >= maxIdleRateLimiters {
+		now := time.Now()
+		maps.DeleteFunc(l.limiters, func(_ limiterKey, limiter *hostLimiter) bool {
+			return limiter.idle(now)
+		})
+	}
+
+	limit, ok := l.overrides[host]
+	if !ok {
+		limit, ok = l.defaults[upstream]
+	}
+	if !ok {
+		limit = RateLimit{Rate: float64(rate.Inf)}
+	}
+	limiter := &hostLimiter{Limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+	l.limiters[key] = limiter
+	return limiter
+}
+
+// Wait blocks until a query can be sent to host. It's only an error if that won't happen before ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context, upstream string, host string) error {
+	if l == nil {
+		return nil
+	}
+
+	limiter := l.limiter(upstream, host)
+	start := time.Now()
+	defer func() {
+		rateLimitWaits.WithLabelValues(upstream).Observe(time.Since(start).Seconds())
+	}()
+
+	l.mu.Lock()
+	pausedUntil := limiter.pausedUntil
+	l.mu.Unlock()
+	if wait := time.Until(pausedUntil); wait > 0 {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(pausedUntil) {
+			return newLookupError(ErrCodeRateLimited, fmt.Errorf("%s is backing off until %s", host, pausedUntil.Format(time.RFC3339)))
+		}
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := limiter.Wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// The queue for host is longer than there's time left to wait
+		return newLookupError(ErrCodeRateLimited, fmt.Errorf("too many queries queued for %s", host), err)
+	}
+	return nil
+}
+
+// Backoff stops queries to host for a while after it's told us we've hit its limit.
+func (l *RateLimiter) Backoff(upstream string, host string) {
+	if l == nil {
+		return
+	}
+
+	limiter := l.limiter(upstream, host)
+	l.mu.Lock()
+	limiter.pausedUntil = time.Now().Add(l.backoff)
+	l.mu.Unlock()
+
+	slog.Warn("upstream query limit hit, backing off", "host", host, "backoff", l.backoff)
+}
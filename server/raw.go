@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/domainr/whois"
+	"github.com/openrdap/rdap"
+)
+
+// RawResponse is an upstream response exactly as we received it, for when the parsed DomainInfo looks wrong.
+type RawResponse struct {
+	Source InfoSource `json:"source"`
+	// Server is the RDAP URL or the WHOIS host that was asked.
+	Server string `json:"server"`
+	// Status is the HTTP status code of an RDAP response.
+	Status int `json:"status,omitempty"`
+	// Json is set for RDAP responses that are valid JSON, Text for WHOIS responses and anything else.
+	Json json.RawMessage `json:"json,omitempty"`
+	Text string          `json:"text,omitempty"`
+}
+
+// rawRdapResponse captures the last HTTP response the RDAP client got, whether or not it was a success.
+func rawRdapResponse(source InfoSource, resp *rdap.Response) (RawResponse, bool) {
+	if resp == nil || len(resp.HTTP) == 0 {
+		return RawResponse{}, false
+	}
+
+	httpResp := resp.HTTP[len(resp.HTTP)-1]
+	raw := RawResponse{
+		Source: source,
+		Server: httpResp.URL,
+	}
+	if httpResp.Response != nil {
+		raw.Status = httpResp.Response.StatusCode
+	}
+	if json.Valid(httpResp.Body) {
+		raw.Json = httpResp.Body
+	} else {
+		raw.Text = string(httpResp.Body)
+	}
+
+	return raw, true
+}
+
+func rawWhoisResponse(source InfoSource, resp *whois.Response) RawResponse {
+	return RawResponse{
+		Source: source,
+		Server: resp.Host,
+		Text:   resp.String(),
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openrdap/rdap"
+	"github.com/openrdap/rdap/bootstrap"
+)
+
+const (
+	defaultRdapBootstrapUrl     = bootstrap.DefaultBaseURL + "dns.json"
+	defaultRdapBootstrapRefresh = 24 * time.Hour
+)
+
+// RdapBootstrap finds the RDAP server for a domain. IANA's bootstrap registry is kept in memory, and in file if
+// there is one so a restart doesn't have to download it again, and refreshed every refresh. overrides are checked
+// first, so we can point TLDs at servers IANA doesn't list (a lot of ccTLDs) or away from ones that misbehave.
+type RdapBootstrap struct {
+	file      *DataFile
+	overrides map[string]*url.URL
+
+	mu       sync.RWMutex
+	registry *bootstrap.DNSRegistry
+}
+
+func NewRdapBootstrap(registryUrl string, file string, refresh time.Duration, overrides map[string]*url.URL) *RdapBootstrap {
+	b := &RdapBootstrap{overrides: overrides}
+	b.file = NewDataFile("RDAP bootstrap", registryUrl, file, refresh, b.parse)
+	return b
+}
+
+// rdapBootstrapFromConfig builds the bootstrap from c and loads the registry from c.BootstrapFile if there's one.
+func rdapBootstrapFromConfig(c RdapConfig) *RdapBootstrap {
+	overrides := make(map[string]*url.URL, len(c.Servers))
+	for suffix, server := range c.Servers {
+		// Validated with the rest of the config
+		overrides[suffix], _ = url.Parse(server)
+	}
+
+	b := NewRdapBootstrap(c.BootstrapUrl, c.BootstrapFile, c.BootstrapRefresh, overrides)
+	b.file.LoadFile()
+	return b
+}
+
+func (b *RdapBootstrap) parse(body []byte) error {
+	registry, err := bootstrap.NewDNSRegistry(body)
+	if err != nil {
+		return err
+	}
+	slog.Debug("parsed RDAP bootstrap", "published", registry.File().Publication)
+
+	b.mu.Lock()
+	b.registry = registry
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *RdapBootstrap) current() *bootstrap.DNSRegistry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.registry
+}
+
+// Run keeps the registry up to date until ctx is done.
+func (b *RdapBootstrap) Run(ctx context.Context) {
+	b.file.Run(ctx)
+}
+
+// Lookup returns the RDAP base URLs to try for domain, best first. They're copies, since openrdap scribbles on the
+// server URL of a request.
+func (b *RdapBootstrap) Lookup(ctx context.Context, domain string) ([]*url.URL, error) {
+	domain = normalizeSuffix(domain)
+	if server, ok := matchSuffix(b.overrides, domain); ok {
+		server := *server
+		return []*url.URL{&server}, nil
+	}
+
+	if err := b.file.EnsureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	registry := b.current()
+	answer, err := registry.Lookup(&bootstrap.Question{RegistryType: bootstrap.DNS, Query: domain})
+	if err != nil {
+		return nil, err
+	}
+	if len(answer.URLs) == 0 {
+		return nil, &rdap.ClientError{
+			Type: rdap.BootstrapNoMatch,
+			Text: fmt.Sprintf("No RDAP servers found for '%s'", domain),
+		}
+	}
+
+	urls := make([]*url.URL, len(answer.URLs))
+	for i, u := range answer.URLs {
+		u := *u
+		urls[i] = &u
+	}
+	slices.SortStableFunc(urls, func(a *url.URL, b *url.URL) int {
+		return rdapSchemeRank(b) - rdapSchemeRank(a)
+	})
+	return urls, nil
+}
+
+func rdapSchemeRank(u *url.URL) int {
+	if u.Scheme == "https" {
+		return 1
+	}
+	return 0
+}
+
+// RdapClient makes RDAP requests over one HTTP client for the life of the server, so connections to registries
+// are reused, with servers found through bootstrap rather than openrdap's own bootstrap client, which downloads the
+// registry afresh for every rdap.Client and isn't safe to share.
+type RdapClient struct {
+	http      *http.Client
+	bootstrap *RdapBootstrap
+}
+
+// rdapClient is used by every RDAP lookup. It's set up at startup.
+var rdapClient *RdapClient
+
+func NewRdapClient(bootstrap *RdapBootstrap) *RdapClient {
+	return &RdapClient{
+		http: &http.Client{
+			Transport: instrumentedTransport{
+				base: &http.Transport{
+					// sourcePool is looked up on every dial rather than bound here, so it's whatever main set up
+					DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+						return sourcePool.DialContext(ctx, network, address)
+					},
+					ForceAttemptHTTP2:   true,
+					MaxIdleConnsPerHost: 4,
+					IdleConnTimeout:     90 * time.Second,
+				},
+			},
+		},
+		bootstrap: bootstrap,
+	}
+}
+
+// Do runs req, finding the server through bootstrap if req doesn't have one. Each of the servers bootstrap gives
+// is tried in turn until one answers, as openrdap would. tld labels the metrics for the requests.
+func (c *RdapClient) Do(ctx context.Context, req *rdap.Request, tld string) (*rdap.Response, error) {
+	logger := loggerFrom(ctx).With("domain", req.Query)
+	var verboseFunc func(string)
+	if logger.Enabled(ctx, slog.LevelDebug) {
+		verboseFunc = func(s string) {
+			if s = strings.TrimSpace(s); s != "" {
+				logger.Debug(s)
+			}
+		}
+	}
+	client := &rdap.Client{
+		HTTP:      c.http,
+		Bootstrap: &bootstrap.Client{},
+		Verbose:   verboseFunc,
+	}
+
+	ctx = withRdapTld(ctx, tld)
+	if req.Server != nil {
+		return client.Do(req.WithContext(ctx))
+	}
+
+	servers, err := c.bootstrap.Lookup(ctx, req.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	var tried []*rdap.HTTPResponse
+	var resp *rdap.Response
+	for _, server := range servers {
+		resp, err = client.Do(req.WithServer(server).WithContext(ctx))
+		if resp != nil {
+			tried = append(tried, resp.HTTP...)
+			resp.HTTP = tried
+		}
+
+		var clientErr *rdap.ClientError
+		if err == nil || ctx.Err() != nil || errors.As(err, &clientErr) && clientErr.Type == rdap.ObjectDoesNotExist {
+			break
+		}
+	}
+	return resp, err
+}
+
+type rdapTldKey struct{}
+
+func withRdapTld(ctx context.Context, tld string) context.Context {
+	return context.WithValue(ctx, rdapTldKey{}, tld)
+}
+
+// rdapTldFrom is the TLD label for the metrics of an RDAP request made with ctx.
+func rdapTldFrom(ctx context.Context) string {
+	tld, _ := ctx.Value(rdapTldKey{}).(string)
+	return tld
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultRegistrarsUrl     = "https://www.iana.org/assignments/registrar-ids/registrar-ids-1.csv"
+	defaultRegistrarsRefresh = 24 * time.Hour
+)
+
+// registrarSnapshot is a small seed of IANA registrar IDs and names built into the binary, so the most common
+// registrars can be named before the list is downloaded, or without ever downloading it. It has no status or RDAP
+// URLs; run go generate to replace it with IANA's full list.
+//
+//go:generate curl -fsSL -o registrar-ids.csv https://www.iana.org/assignments/registrar-ids/registrar-ids-1.csv
+//go:embed registrar-ids.csv
+var registrarSnapshot []byte
+
+// Registrar is an entry in IANA's registrar list, with whatever our overrides add to it.
+type Registrar struct {
+	IanaId int    `json:"ianaId"`
+	Name   string `json:"name"`
+	// Status is IANA's, like "Accredited", "Terminated" or "Reserved".
+	Status      string `json:"status,omitempty"`
+	RdapUrl     string `json:"rdapUrl,omitempty"`
+	WhoisServer string `json:"whoisServer,omitempty"`
+	Website     string `json:"website,omitempty"`
+}
+
+// RegistrarDirectory looks registrars up by IANA ID, or by name for WHOIS servers that only give one. It starts out
+// with registrarSnapshot, and IANA's list is then kept like the RDAP bootstrap: downloaded, saved to file if there is
+// one, and refreshed. Without a URL the file is the only source, so the list can be kept up to date offline.
+type RegistrarDirectory struct {
+	file      *DataFile
+	overrides map[int]RegistrarOverride
+
+	mu     sync.RWMutex
+	byId   map[int]Registrar
+	byName map[string]int
+}
+
+// registrarDirectory is used to enrich every lookup, and by /registrar. It's set up at startup.
+var registrarDirectory *RegistrarDirectory
+
+func NewRegistrarDirectory(listUrl string, file string, refresh time.Duration, overrides map[int]RegistrarOverride) *RegistrarDirectory {
+	d := &RegistrarDirectory{overrides: overrides}
+	if err := d.parse(registrarSnapshot); err != nil {
+		slog.Warn("failed to load built-in registrar list", "err", err)
+		d.set(nil)
+	}
+	if listUrl != "" || file != "" {
+		d.file = NewDataFile("registrar list", listUrl, file, refresh, d.parse)
+	}
+	return d
+}
+
+// registrarDirectoryFromConfig builds the directory from c and loads the list from c.File if there's one.
+func registrarDirectoryFromConfig(c RegistrarConfig) *RegistrarDirectory {
+	d := NewRegistrarDirectory(c.Url, c.File, c.Refresh, c.Overrides)
+	if d.file != nil {
+		d.file.LoadFile()
+	}
+	return d
+}
+
+// parse reads IANA's CSV, whose columns are "ID", "Registrar Name", "Status" and "RDAP Base URL". Columns are found
+// by their headings, so a list kept by hand can add "WHOIS Server" and "Website" columns.
+func (d *RegistrarDirectory) parse(body []byte) error {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\ufeff"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return errors.New("registrar list is empty")
+	}
+
+	columns := make(map[string]int)
+	for i, heading := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(heading))] = i
+	}
+	idCol, ok := columns["id"]
+	if !ok {
+		return errors.New(`registrar list has no "ID" column`)
+	}
+	nameCol, ok := columns["registrar name"]
+	if !ok {
+		return errors.New(`registrar list has no "Registrar Name" column`)
+	}
+	field := func(row []string, heading string) string {
+		if i, ok := columns[heading]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	registrars := make([]Registrar, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		if idCol >= len(row) || nameCol >= len(row) {
+			continue
+		}
+		ianaId, err := strconv.Atoi(strings.TrimSpace(row[idCol]))
+		if err != nil || ianaId <= 0 {
+			continue
+		}
+		registrars = append(registrars, Registrar{
+			IanaId:      ianaId,
+			Name:        strings.TrimSpace(row[nameCol]),
+			Status:      field(row, "status"),
+			RdapUrl:     field(row, "rdap base url"),
+			WhoisServer: strings.ToLower(field(row, "whois server")),
+			Website:     field(row, "website"),
+		})
+	}
+	if len(registrars) == 0 {
+		return errors.New("registrar list has no registrars")
+	}
+
+	d.set(registrars)
+	return nil
+}
+
+// set replaces the directory with registrars and the overrides on top of them.
+func (d *RegistrarDirectory) set(registrars []Registrar) {
+	byId := make(map[int]Registrar, len(registrars)+len(d.overrides))
+	for _, registrar := range registrars {
+		byId[registrar.IanaId] = registrar
+	}
+	for ianaId, override := range d.overrides {
+		byId[ianaId] = override.apply(byId[ianaId], ianaId)
+	}
+
+	// Names aren't unique, a registrar that's been terminated and reaccredited is listed twice, so the accredited
+	// one wins, and a name that's still ambiguous isn't matched at all
+	named := make(map[string][]int, len(byId))
+	for ianaId, registrar := range byId {
+		if key := registrarNameKey(registrar.Name); key != "" {
+			named[key] = append(named[key], ianaId)
+		}
+	}
+	byName := make(map[string]int, len(named))
+	for key, ianaIds := range named {
+		if len(ianaIds) > 1 {
+			ianaIds = slices.DeleteFunc(ianaIds, func(ianaId int) bool {
+				return !strings.EqualFold(byId[ianaId].Status, "Accredited")
+			})
+		}
+		if len(ianaIds) == 1 {
+			byName[key] = ianaIds[0]
+		}
+	}
+
+	d.mu.Lock()
+	d.byId = byId
+	d.byName = byName
+	d.mu.Unlock()
+}
+
+// registrarNameKey is what's left of a name to compare once case, punctuation and spacing are dropped, since WHOIS
+// servers write "MarkMonitor, Inc." where IANA lists "MarkMonitor Inc.".
+func registrarNameKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// Lookup finds a registrar by IANA ID, or by name if there's no ID. It only uses what's already loaded, so lookups
+// are never held up by a download.
+func (d *RegistrarDirectory) Lookup(ianaId int, name string) (Registrar, bool) {
+	if d == nil {
+		return Registrar{}, false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if ianaId <= 0 {
+		ianaId = d.byName[registrarNameKey(name)]
+	}
+	registrar, ok := d.byId[ianaId]
+	return registrar, ok
+}
+
+// Get finds a registrar by IANA ID. Until the list has been loaded from its file or URL, that's from the built-in
+// copy.
+func (d *RegistrarDirectory) Get(ianaId int) (Registrar, error) {
+	if d == nil {
+		return Registrar{}, newLookupError(ErrCodeNotFound, errors.New("the registrar directory is not enabled"))
+	}
+
+	registrar, ok := d.Lookup(ianaId, "")
+	if !ok {
+		return Registrar{}, newLookupError(ErrCodeNotFound, fmt.Errorf("no registrar with IANA ID %d", ianaId))
+	}
+	return registrar, nil
+}
+
+// Run keeps the list up to date until ctx is done.
+func (d *RegistrarDirectory) Run(ctx context.Context) {
+	if d.file != nil {
+		d.file.Run(ctx)
+	}
+}
+
+// apply fills in registrar from the override, for a registrar IANA doesn't list, or lists without a WHOIS server
+// or website.
+func (o RegistrarOverride) apply(registrar Registrar, ianaId int) Registrar {
+	registrar.IanaId = ianaId
+	for _, field := range []struct {
+		value string
+		set   *string
+	}{
+		{o.Name, &registrar.Name},
+		{o.RdapUrl, &registrar.RdapUrl},
+		{strings.ToLower(o.WhoisServer), &registrar.WhoisServer},
+		{o.Website, &registrar.Website},
+	} {
+		if field.value != "" {
+			*field.set = field.value
+		}
+	}
+	return registrar
+}
+
+// withRegistrarDetails fills in what the directory knows about the registrar, which is often more than the lookup
+// gave: a WHOIS server may only give a name, and RDAP servers rarely give a website.
+func withRegistrarDetails(info DomainInfo) DomainInfo {
+	registrar, ok := registrarDirectory.Lookup(info.RegistrarIanaId, registrarName(info.Registrar))
+	if !ok {
+		return info
+	}
+
+	info.RegistrarDetails = &registrar
+	info.RegistrarIanaId = registrar.IanaId
+	if registrarName(info.Registrar) == "" {
+		info.Registrar = registrar.Name
+	}
+	return info
+}
+
+func registrarInfo(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	ianaId, err := strconv.Atoi(mux.Vars(req)["ianaId"])
+	if err != nil || ianaId <= 0 {
+		writeError(w, encoder, invalidInput(fmt.Errorf("%q is not an IANA registrar ID", mux.Vars(req)["ianaId"])))
+		return
+	}
+
+	registrar, err := registrarDirectory.Get(ianaId)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(registrar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
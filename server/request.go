@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxHostnameLength = 253
+	maxLabelLength    = 63
+)
+
+type infoRequest struct {
+	Domain  string
+	Options InfoOptions
+	Timeout time.Duration
+	// BypassCache skips the cache and fetches a fresh result, which is then cached.
+	BypassCache bool
+}
+
+type dnsRequest struct {
+	Hostname    string
+	Nameservers []string
+	Ips         []netip.Addr
+	Deep        bool
+	Timeout     time.Duration
+}
+
+// normalizeHostname validates a user-supplied hostname, which may be given as U-labels, A-labels or a mix of the two,
+// and returns it in lowercase A-label form without a trailing dot.
+func normalizeHostname(hostname string) (string, error) {
+	hostname = strings.TrimSuffix(strings.TrimSpace(hostname), ".")
+	if hostname == "" {
+		return "", invalidInput(errors.New("hostname must not be empty"))
+	}
+
+	ascii, err := hostnameProfile.ToASCII(hostname)
+	if err != nil {
+		return "", invalidInput(fmt.Errorf("%q is not a valid hostname", hostname), err)
+	}
+
+	if len(ascii) > maxHostnameLength {
+		return "", invalidInput(fmt.Errorf("%q is longer than %d characters", hostname, maxHostnameLength))
+	}
+
+	for _, label := range strings.Split(ascii, ".") {
+		if len(label) == 0 {
+			return "", invalidInput(fmt.Errorf("%q contains an empty label", hostname))
+		}
+		if len(label) > maxLabelLength {
+			return "", invalidInput(fmt.Errorf("label %q is longer than %d characters", label, maxLabelLength))
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", invalidInput(fmt.Errorf("label %q must not start or end with a hyphen", label))
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return "", invalidInput(fmt.Errorf("label %q contains invalid character %q", label, r))
+			}
+		}
+	}
+
+	return ascii, nil
+}
+
+// splitList splits a comma-separated query parameter, dropping empty entries so "a,,b," is the same as "a,b".
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseBoolParam(name string, s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, invalidInput(fmt.Errorf("%q is not a valid value for `%s`", s, name))
+	}
+	return b, nil
+}
+
+func parseInfoRequest(req *http.Request) (infoRequest, error) {
+	query := req.URL.Query()
+
+	domain, err := normalizeHostname(mux.Vars(req)["domain"])
+	if err != nil {
+		return infoRequest{}, err
+	}
+
+	lookupType, err := ParseLookupType(query.Get("type"))
+	if err != nil {
+		return infoRequest{}, invalidInput(err)
+	}
+
+	lookupSource, err := ParseLookupSource(query.Get("source"))
+	if err != nil {
+		return infoRequest{}, invalidInput(err)
+	}
+
+	precedence, err := ParseMergePrecedence(query.Get("precedence"))
+	if err != nil {
+		return infoRequest{}, invalidInput(err)
+	}
+
+	includeRaw := false
+	for _, include := range splitList(strings.ToLower(query.Get("include"))) {
+		switch include {
+		case "raw":
+			includeRaw = true
+		default:
+			return infoRequest{}, invalidInput(fmt.Errorf("%q is not a valid value for `include`", include))
+		}
+	}
+
+	privateSuffix, err := ParsePrivateSuffixMode(query.Get("privateSuffix"))
+	if err != nil {
+		return infoRequest{}, invalidInput(err)
+	}
+
+	timeout, err := parseTimeout(query.Get("timeout"))
+	if err != nil {
+		return infoRequest{}, err
+	}
+
+	bypassCache := false
+	switch cache := strings.ToLower(query.Get("cache")); cache {
+	case "", "default":
+	case "bypass":
+		bypassCache = true
+	default:
+		return infoRequest{}, invalidInput(fmt.Errorf("%q is not a valid value for `cache`", cache))
+	}
+
+	return infoRequest{
+		Domain: domain,
+		Options: InfoOptions{
+			Type:          lookupType,
+			Source:        lookupSource,
+			Precedence:    precedence,
+			IncludeRaw:    includeRaw,
+			PrivateSuffix: privateSuffix,
+		},
+		Timeout:     timeout,
+		BypassCache: bypassCache,
+	}, nil
+}
+
+func parseDnsRequest(req *http.Request) (dnsRequest, error) {
+	query := req.URL.Query()
+
+	hostname, err := normalizeHostname(mux.Vars(req)["hostname"])
+	if err != nil {
+		return dnsRequest{}, err
+	}
+
+	ns := splitList(query.Get("ns"))
+	ip := splitList(query.Get("ip"))
+	if (len(ns) > 0) == (len(ip) > 0) {
+		return dnsRequest{}, invalidInput(errors.New("you must provide `ns`es or `ip`s, but not both"))
+	}
+
+	deep, err := parseBoolParam("deep", query.Get("deep"))
+	if err != nil {
+		return dnsRequest{}, err
+	}
+
+	timeout, err := parseTimeout(query.Get("timeout"))
+	if err != nil {
+		return dnsRequest{}, err
+	}
+
+	var nameservers []string
+	for _, nameserver := range ns {
+		nameserver, err := normalizeHostname(nameserver)
+		if err != nil {
+			return dnsRequest{}, err
+		}
+		nameservers = append(nameservers, nameserver)
+	}
+
+	var ips []netip.Addr
+	for _, s := range ip {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return dnsRequest{}, invalidInput(fmt.Errorf("%q is not a valid IP address", s))
+		}
+		ips = append(ips, addr.Unmap())
+	}
+
+	return dnsRequest{
+		Hostname:    hostname,
+		Nameservers: nameservers,
+		Ips:         ips,
+		Deep:        deep,
+		Timeout:     timeout,
+	}, nil
+}
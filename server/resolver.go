@@ -11,6 +11,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"math/rand"
 	"net"
 	"net/netip"
@@ -19,6 +21,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -36,6 +39,9 @@ const (
 	// udpQueryTimeout is the amount of time we wait for a UDP response
 	// from a nameserver before falling back to a TCP connection.
 	udpQueryTimeout = 5 * time.Second
+	// defaultResolverCacheSize is how many responses a resolver keeps by
+	// default.
+	defaultResolverCacheSize = 10000
 
 	// These constants aren't typed in the DNS package, so we create typed
 	// versions here to avoid having to do repeated type casts.
@@ -46,7 +52,7 @@ const (
 var (
 	// ErrMaxDepth is returned when recursive resolving exceeds the maximum
 	// depth limit for this package.
-	ErrMaxDepth = fmt.Errorf("exceeded max depth %d when resolving", maxDepth)
+	ErrMaxDepth = errors.New("exceeded max depth when resolving")
 
 	// ErrAuthoritativeNoResponses is the error returned when an
 	// authoritative nameserver indicates that there are no responses to
@@ -101,6 +107,18 @@ type Resolver struct {
 	// records and will avoid contacting nameservers over IPv6.
 	NoIPv6 bool
 
+	// Logger gets the resolver's step by step debug output. If nil, there
+	// isn't any.
+	Logger *slog.Logger
+
+	// UdpTimeout and MaxDepth override udpQueryTimeout and maxDepth if
+	// they're set.
+	UdpTimeout time.Duration
+	MaxDepth   int
+
+	// MaxCacheEntries caps queryCache. If 0, it isn't capped.
+	MaxCacheEntries int
+
 	// Caching
 	// NOTE(andrew): if we make resolution parallel, this needs a mutex
 	queryCache map[dnsQuery]dnsMsgWithExpiry
@@ -134,12 +152,42 @@ type dnsMsgWithExpiry struct {
 	expiresAt time.Time
 }
 
+// newResolver returns a Resolver set up from the server's config, logging to
+// ctx's logger.
+func newResolver(ctx context.Context) *Resolver {
+	return &Resolver{
+		NoIPv6:          config.Resolver.NoIpv6,
+		Logger:          loggerFrom(ctx),
+		UdpTimeout:      config.Resolver.UdpTimeout,
+		MaxDepth:        config.Resolver.MaxDepth,
+		MaxCacheEntries: config.Resolver.CacheSize,
+		queryCache:      map[dnsQuery]dnsMsgWithExpiry{},
+	}
+}
+
+func (r *Resolver) udpTimeout() time.Duration {
+	if r.UdpTimeout > 0 {
+		return r.UdpTimeout
+	}
+	return udpQueryTimeout
+}
+
+func (r *Resolver) depthLimit() int {
+	if r.MaxDepth > 0 {
+		return r.MaxDepth
+	}
+	return maxDepth
+}
+
 func (r *Resolver) now() time.Time {
 	return time.Now()
 }
 
 func (r *Resolver) logf(format string, args ...any) {
-	//fmt.Printf(strings.TrimSuffix(format, "\n")+"\n", args...)
+	if r.Logger == nil || !r.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	r.Logger.Debug(fmt.Sprintf(strings.TrimSuffix(format, "\n"), args...))
 }
 
 func (r *Resolver) depthlogf(depth int, format string, args ...any) {
@@ -293,7 +341,7 @@ func (r *Resolver) resolveRecursive(
 	nameserver netip.Addr,
 	qtype dns.Type,
 ) ([]netip.Addr, time.Duration, error) {
-	if depth == maxDepth {
+	if depth == r.depthLimit() {
 		r.depthlogf(depth, "not recursing past maximum depth")
 		return nil, 0, ErrMaxDepth
 	}
@@ -480,7 +528,7 @@ func (r *Resolver) queryNameserver(
 
 	// Handle the case where UDP is blocked by adding an explicit timeout
 	// for the UDP portion of this query.
-	udpCtx, udpCtxCancel := context.WithTimeout(ctx, udpQueryTimeout)
+	udpCtx, udpCtxCancel := context.WithTimeout(ctx, r.udpTimeout())
 	defer udpCtxCancel()
 
 	msg, err := r.queryNameserverProto(udpCtx, depth, name, nameserver, "udp", qtype)
@@ -516,10 +564,12 @@ func (r *Resolver) queryNameserverProto(
 		qtype:      qtype,
 	}
 	cacheEntry, ok := r.queryCache[cacheKey]
-	if ok && cacheEntry.expiresAt.Before(now) {
+	if ok && cacheEntry.expiresAt.After(now) {
 		r.depthlogf(depth, "using cached response from %s about %q (type: %v)", nameserverStr, name, qtype)
+		resolverCacheLookups.WithLabelValues("hit").Inc()
 		return cacheEntry.Msg, nil
 	}
+	resolverCacheLookups.WithLabelValues("miss").Inc()
 
 	var network string
 	if nameserver.Is4() {
@@ -534,6 +584,10 @@ func (r *Resolver) queryNameserverProto(
 	m.SetEdns0(1232, false /* no DNSSEC */)
 	m.SetQuestion(strings.TrimSuffix(name, ".")+".", uint16(qtype))
 
+	if err := rateLimiter.Wait(ctx, upstreamResolver, nameserverStr); err != nil {
+		return nil, err
+	}
+
 	// Dial the current nameserver using our dialer.
 	var nconn net.Conn
 	nconn, err = r.dialer().DialContext(ctx, network, net.JoinHostPort(nameserverStr, "53"))
@@ -549,7 +603,18 @@ func (r *Resolver) queryNameserverProto(
 
 	// Send the DNS request to the current nameserver.
 	r.depthlogf(depth, "asking %s over %s about %q (type: %v)", nameserverStr, protocol, name, qtype)
-	resp, _, err = c.ExchangeWithConnContext(ctx, m, conn)
+	start := time.Now()
+	spanCtx, span := startUpstreamSpan(ctx, upstreamResolver, nameserverStr,
+		attribute.String("network.transport", protocol), attribute.String("dns.question.name", name),
+		attribute.String("dns.question.type", qtype.String()))
+	queryCtx, cancel := upstreamContext(spanCtx, nameserverStr)
+	resp, _, err = c.ExchangeWithConnContext(queryCtx, m, conn)
+	cancel()
+	if resp != nil {
+		span.SetAttributes(attribute.String("dns.response.rcode", dns.RcodeToString[resp.Rcode]))
+	}
+	endSpan(span, err)
+	observeUpstream(upstreamResolver, tldOf(name), nameserverStr, start, err)
 
 	if err != nil {
 		return nil, err
@@ -576,6 +641,14 @@ func (r *Resolver) queryNameserverProto(
 		minTTL = min(minTTL, int(rr.Header().Ttl))
 	}
 
+	if r.MaxCacheEntries > 0 && len(r.queryCache) >= r.MaxCacheEntries {
+		maps.DeleteFunc(r.queryCache, func(_ dnsQuery, entry dnsMsgWithExpiry) bool {
+			return !entry.expiresAt.After(now)
+		})
+		if len(r.queryCache) >= r.MaxCacheEntries {
+			return resp, nil
+		}
+	}
 	r.queryCache[cacheKey] = dnsMsgWithExpiry{
 		Msg:       resp,
 		expiresAt: now.Add(time.Duration(minTTL) * time.Second),
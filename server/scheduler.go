@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// watchTick is how often the scheduler looks for entries that are due.
+	watchTick = 15 * time.Second
+	// watchRunTimeout bounds all the checks of one run of an entry.
+	watchRunTimeout         = 2 * time.Minute
+	defaultWatchConcurrency = 4
+	defaultWatchJitter      = 0.1
+)
+
+// Scheduler runs the checks of every watchlist entry once its NextRun comes around. At most concurrency entries run
+// at once, and each run is followed by the next one an interval later, give or take jitter (a fraction of the
+// interval) so entries added together don't stay in lockstep and hammer the same upstreams.
+type Scheduler struct {
+	store       *Store
+	concurrency int
+	jitter      float64
+	wake        chan struct{}
+
+	mu        sync.Mutex
+	running   map[string]bool
+	observers []func(context.Context, WatchEntry, WatchRun)
+}
+
+// scheduler is the server's Scheduler. It's set up at startup, once the store is open.
+var scheduler *Scheduler
+
+func NewScheduler(store *Store, concurrency int, jitter float64) *Scheduler {
+	return &Scheduler{
+		store:       store,
+		concurrency: max(concurrency, 1),
+		jitter:      min(max(jitter, 0), 1),
+		wake:        make(chan struct{}, 1),
+		running:     make(map[string]bool),
+	}
+}
+
+// OnRun registers f to be called with every finished run. The context carries the run's request ID for logging.
+func (s *Scheduler) OnRun(f func(context.Context, WatchEntry, WatchRun)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, f)
+}
+
+// Wake makes the scheduler look for due entries now instead of at the next tick.
+func (s *Scheduler) Wake() {
+	if s == nil {
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run schedules entries until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	sem := make(chan struct{}, s.concurrency)
+	ticker := time.NewTicker(watchTick)
+	defer ticker.Stop()
+
+	for {
+		s.runDue(ctx, sem)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *Scheduler) runDue(ctx context.Context, sem chan struct{}) {
+	entries, err := s.store.ListWatches()
+	if err != nil {
+		slog.Error("failed to list watchlist", "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.NextRun.After(now) {
+			continue
+		}
+
+		s.mu.Lock()
+		if s.running[entry.Id] {
+			s.mu.Unlock()
+			continue
+		}
+		s.running[entry.Id] = true
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.running, entry.Id)
+				s.mu.Unlock()
+			}()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			s.runEntry(ctx, entry)
+		}()
+	}
+}
+
+func (s *Scheduler) runEntry(ctx context.Context, entry WatchEntry) {
+	// Runs aren't requests, but they get an ID the same way so everything they log can be tied together
+	ctx = withRequestId(ctx, newRequestId())
+	logger := loggerFrom(ctx).With("entryId", entry.Id, "domain", entry.Domain)
+	logger.Debug("running watchlist checks", "checks", entry.Checks)
+
+	runCtx, cancel := context.WithTimeout(ctx, watchRunTimeout)
+	defer cancel()
+
+	run := runChecks(runCtx, entry)
+
+	// The entry may have been edited while it ran, in which case the edit already decided when it runs next
+	updated, err := s.store.UpdateWatch(entry.Id, func(current *WatchEntry) {
+		current.LastRun = &run.Time
+		if current.NextRun.Equal(entry.NextRun) {
+			current.NextRun = s.nextRun(run.Time, time.Duration(current.Interval))
+		}
+	})
+	if err != nil {
+		// Most likely deleted while it ran, so there's nothing to record the run against
+		logger.Warn("failed to reschedule watchlist entry", "err", err)
+		return
+	}
+
+	if err := s.store.RecordWatchRun(run); err != nil {
+		logger.Error("failed to record watchlist run", "err", err)
+	}
+
+	s.mu.Lock()
+	observers := s.observers
+	s.mu.Unlock()
+	for _, observer := range observers {
+		observer(ctx, updated, run)
+	}
+}
+
+func (s *Scheduler) nextRun(from time.Time, interval time.Duration) time.Time {
+	offset := time.Duration((rand.Float64()*2 - 1) * s.jitter * float64(interval))
+	return from.Add(interval + offset)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SourceStrategy is how a SourcePool picks the address to query an upstream from.
+type SourceStrategy string
+
+const (
+	// sourceRoundRobin takes turns across every upstream.
+	sourceRoundRobin SourceStrategy = "round-robin"
+	// sourceLeastRecentlyUsed picks the address that's gone longest without querying this upstream.
+	sourceLeastRecentlyUsed SourceStrategy = "least-recently-used"
+	// sourceSticky keeps using the same address for an upstream until it's cooling down.
+	sourceSticky SourceStrategy = "sticky"
+)
+
+const defaultSourceCooldown = 5 * time.Minute
+
+func ParseSourceStrategy(s string) (SourceStrategy, error) {
+	switch strategy := SourceStrategy(s); strategy {
+	case sourceRoundRobin, sourceLeastRecentlyUsed, sourceSticky:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("%q is not a valid source strategy, must be %s, %s or %s", s, sourceRoundRobin, sourceLeastRecentlyUsed, sourceSticky)
+	}
+}
+
+type hostSource struct {
+	host   string
+	source netip.Addr
+}
+
+// SourcePool spreads RDAP and WHOIS queries over several local addresses, since upstreams rate limit by source IP.
+// An address that gets rate limited by an upstream cools down and isn't used for that upstream again until it's
+// had a rest, unless every other address is cooling down too.
+type SourcePool struct {
+	addrs    []netip.Addr
+	strategy SourceStrategy
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	next      int
+	lastUsed  map[hostSource]time.Time
+	coolUntil map[hostSource]time.Time
+	sticky    map[string]netip.Addr
+}
+
+// sourcePool is where lookups dial upstreams from. A nil pool dials from whatever address the system picks.
+var sourcePool *SourcePool
+
+func NewSourcePool(addrs []netip.Addr, strategy SourceStrategy, cooldown time.Duration) *SourcePool {
+	return &SourcePool{
+		addrs:     addrs,
+		strategy:  strategy,
+		cooldown:  cooldown,
+		lastUsed:  make(map[hostSource]time.Time),
+		coolUntil: make(map[hostSource]time.Time),
+		sticky:    make(map[string]netip.Addr),
+	}
+}
+
+// sourcePoolFromConfig returns nil if no source addresses are configured.
+func sourcePoolFromConfig(c Config) *SourcePool {
+	if len(c.SourceIps) == 0 {
+		return nil
+	}
+
+	addrs := make([]netip.Addr, 0, len(c.SourceIps))
+	for _, ip := range c.SourceIps {
+		// Validated with the rest of the config
+		addrs = append(addrs, netip.MustParseAddr(ip).Unmap())
+	}
+	strategy, _ := ParseSourceStrategy(c.SourceStrategy)
+	return NewSourcePool(addrs, strategy, c.SourceCooldown)
+}
+
+// pick chooses the address to query host from, for a destination in the family is6 says. It returns false if the
+// pool doesn't have any addresses in that family.
+func (p *SourcePool) pick(host string, is6 bool) (netip.Addr, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+
+	var family, available []netip.Addr
+	for _, addr := range p.addrs {
+		if addr.Is6() != is6 {
+			continue
+		}
+		family = append(family, addr)
+		if !p.coolUntil[hostSource{host, addr}].After(now) {
+			available = append(available, addr)
+		}
+	}
+	if len(family) == 0 {
+		return netip.Addr{}, false
+	}
+
+	var addr netip.Addr
+	switch {
+	case len(available) == 0:
+		// Everything is cooling down, so use whichever recovers first rather than failing outright
+		addr = family[0]
+		for _, candidate := range family[1:] {
+			if p.coolUntil[hostSource{host, candidate}].Before(p.coolUntil[hostSource{host, addr}]) {
+				addr = candidate
+			}
+		}
+	case p.strategy == sourceRoundRobin:
+		addr = available[p.next%len(available)]
+		p.next++
+	case p.strategy == sourceSticky && slices.Contains(available, p.sticky[host]):
+		addr = p.sticky[host]
+	default:
+		addr = available[0]
+		for _, candidate := range available[1:] {
+			if p.lastUsed[hostSource{host, candidate}].Before(p.lastUsed[hostSource{host, addr}]) {
+				addr = candidate
+			}
+		}
+	}
+
+	p.lastUsed[hostSource{host, addr}] = now
+	if p.strategy == sourceSticky {
+		p.sticky[host] = addr
+	}
+	return addr, true
+}
+
+// rank is 1 if the pool has addresses in remote's family, otherwise 0.
+func (p *SourcePool) rank(remote netip.Addr) int {
+	for _, addr := range p.addrs {
+		if addr.Is6() == remote.Is6() {
+			return 1
+		}
+	}
+	return 0
+}
+
+// CoolDown stops local being used to query host for a while. local is the LocalAddr of the connection that was
+// rate limited, and anything that isn't one of the pool's addresses is ignored.
+func (p *SourcePool) CoolDown(host string, local net.Addr) {
+	if p == nil || local == nil {
+		return
+	}
+	addrPort, err := netip.ParseAddrPort(local.String())
+	if err != nil {
+		return
+	}
+	addr := addrPort.Addr().Unmap()
+	if !slices.Contains(p.addrs, addr) {
+		return
+	}
+
+	p.mu.Lock()
+	p.coolUntil[hostSource{host, addr}] = time.Now().Add(p.cooldown)
+	if p.sticky[host] == addr {
+		delete(p.sticky, host)
+	}
+	p.mu.Unlock()
+
+	sourceCooldowns.WithLabelValues(addr.String()).Inc()
+	slog.Warn("source address rate limited, cooling down", "host", host, "source", addr, "cooldown", p.cooldown)
+}
+
+// DialContext connects to address from an address picked from the pool, trying each of the host's IPs in turn.
+// It can be used as the DialContext of an http.Transport or a whois.Client.
+func (p *SourcePool) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if p == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	var remotes []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		remotes = []netip.Addr{addr}
+	} else {
+		remotes, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Try the family we have source addresses for first, so an IPv4-only pool isn't bypassed over IPv6
+	for i := range remotes {
+		remotes[i] = remotes[i].Unmap()
+	}
+	slices.SortStableFunc(remotes, func(a netip.Addr, b netip.Addr) int {
+		return p.rank(b) - p.rank(a)
+	})
+
+	var errs []error
+	for _, remote := range remotes {
+		if remote.Is4() && network == "tcp6" || remote.Is6() && network == "tcp4" {
+			continue
+		}
+
+		var dialer net.Dialer
+		if source, ok := p.pick(host, remote.Is6()); ok {
+			dialer.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+		}
+		conn, err := dialer.DialContext(ctx, network, netip.AddrPortFrom(remote, uint16(port)).String())
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no %s addresses for %s", network, host)
+	}
+	return nil, errors.Join(errs...)
+}
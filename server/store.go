@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store persists what the server needs to remember between requests in an embedded bbolt database. Each kind of
+// data gets its own top-level bucket, and time series (like lookup history) get a sub-bucket per name keyed by time
+// so they can be walked in order.
+type Store struct {
+	db *bolt.DB
+}
+
+const (
+	// storePruneInterval is how often the time series are pruned to the configured retention.
+	storePruneInterval     = time.Hour
+	defaultRetentionMaxAge = 365 * 24 * time.Hour
+	defaultRetentionMax    = 1000
+)
+
+// store is the server's Store. It's opened at startup, and the server doesn't run if it can't be.
+var store *Store
+
+var storeBuckets = [][]byte{
+	infoHistoryBucket,
+	dnsHistoryBucket,
+	watchlistBucket,
+	watchResultsBucket,
+	alertStateBucket,
+	eventDeliveriesBucket,
+}
+
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to open store"), err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range storeBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Join(errors.New("failed to create store buckets"), err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// timeKey encodes t so that keys sort chronologically.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// putSeries stores v as JSON in name's series within bucket, at time at.
+func (s *Store) putSeries(bucket []byte, name string, at time.Time, v any) error {
+	return s.putSeriesKey(bucket, name, timeKey(at), v)
+}
+
+// putSeriesKey is putSeries for series where several entries can share a time. key must start with the entry's
+// timeKey, and whatever follows tells apart entries with the same time.
+func (s *Store) putSeriesKey(bucket []byte, name string, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		series, err := tx.Bucket(bucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		return series.Put(key, data)
+	})
+}
+
+// listSeries returns up to limit entries from name's series within bucket, newest first, starting with the last one
+// at or before `before`. A limit of 0 or less returns everything.
+func listSeries[T any](s *Store, bucket []byte, name string, before time.Time, limit int) ([]T, error) {
+	entries := make([]T, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		series := tx.Bucket(bucket).Bucket([]byte(name))
+		if series == nil {
+			return nil
+		}
+
+		c := series.Cursor()
+		for k, v := seekBefore(c, before); k != nil && (limit <= 0 || len(entries) < limit); k, v = c.Prev() {
+			var entry T
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+// listSeriesSince is listSeries for the entries after since, and the last one at or before it, which is the one that
+// was current at since.
+func listSeriesSince[T any](s *Store, bucket []byte, name string, since time.Time, before time.Time) ([]T, error) {
+	entries := make([]T, 0)
+	sinceKey := timeKey(since)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		series := tx.Bucket(bucket).Bucket([]byte(name))
+		if series == nil {
+			return nil
+		}
+
+		c := series.Cursor()
+		for k, v := seekBefore(c, before); k != nil; k, v = c.Prev() {
+			var entry T
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			if bytes.Compare(k[:len(sinceKey)], sinceKey) <= 0 {
+				break
+			}
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+// seekBefore moves c to the last key at or before `before`. Seek lands on the first key after it (or nothing), so
+// that's the one before where it lands.
+func seekBefore(c *bolt.Cursor, before time.Time) ([]byte, []byte) {
+	if k, _ := c.Seek(timeKey(before.Add(time.Nanosecond))); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+// prunedSeries are the buckets of time series that retention applies to. keep, if set, spares entries that are
+// still needed however old they are.
+var prunedSeries = []struct {
+	bucket []byte
+	keep   func(v []byte) bool
+}{
+	{bucket: infoHistoryBucket},
+	{bucket: dnsHistoryBucket},
+	{bucket: watchResultsBucket},
+	{bucket: eventDeliveriesBucket, keep: isPendingDelivery},
+}
+
+// Prune deletes the entries of every time series that are older than retention.MaxAge, or aren't among the newest
+// retention.MaxEntries of their series, and returns how many it deleted.
+func (s *Store) Prune(retention RetentionConfig, now time.Time) (int, error) {
+	var cutoff []byte
+	if retention.MaxAge > 0 {
+		cutoff = timeKey(now.Add(-retention.MaxAge))
+	}
+
+	pruned := 0
+	for _, series := range prunedSeries {
+		inBucket := 0
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(series.bucket).ForEachBucket(func(name []byte) error {
+				n, err := pruneSeries(tx.Bucket(series.bucket).Bucket(name), cutoff, retention.MaxEntries, series.keep)
+				inBucket += n
+				return err
+			})
+		})
+		if err != nil {
+			return pruned, err
+		}
+		pruned += inBucket
+	}
+	return pruned, nil
+}
+
+// pruneSeries deletes the entries of series before cutoff, and all but the newest maxEntries, unless keep says
+// otherwise. A nil cutoff or a maxEntries of 0 doesn't limit that way.
+func pruneSeries(series *bolt.Bucket, cutoff []byte, maxEntries int, keep func(v []byte) bool) (int, error) {
+	// Deleting while walking a cursor skips entries, so this collects the keys first
+	var doomed [][]byte
+	c := series.Cursor()
+	i := 0
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		i++
+		tooOld := cutoff != nil && bytes.Compare(k[:len(cutoff)], cutoff) < 0
+		tooMany := maxEntries > 0 && i > maxEntries
+		if (tooOld || tooMany) && (keep == nil || !keep(v)) {
+			doomed = append(doomed, bytes.Clone(k))
+		}
+	}
+
+	for _, k := range doomed {
+		if err := series.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(doomed), nil
+}
+
+// RunPruning prunes the store to retention now and then every storePruneInterval, until ctx is done.
+func (s *Store) RunPruning(ctx context.Context, retention RetentionConfig) {
+	if retention.MaxAge <= 0 && retention.MaxEntries <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(storePruneInterval)
+	defer ticker.Stop()
+	for {
+		pruned, err := s.Prune(retention, time.Now())
+		if err != nil {
+			slog.Error("failed to prune store", "err", err)
+		} else if pruned > 0 {
+			slog.Info("pruned store", "entries", pruned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStorePrune(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	days := func(n int) time.Time { return now.AddDate(0, 0, -n) }
+
+	tests := []struct {
+		name      string
+		retention RetentionConfig
+		// want are the ages in days of the info snapshots left, newest first
+		want []int
+	}{
+		{name: "unbounded", retention: RetentionConfig{}, want: []int{1, 10, 100, 400}},
+		{name: "max age", retention: RetentionConfig{MaxAge: 365 * 24 * time.Hour}, want: []int{1, 10, 100}},
+		{name: "max entries", retention: RetentionConfig{MaxEntries: 2}, want: []int{1, 10}},
+		{name: "both", retention: RetentionConfig{MaxAge: 50 * 24 * time.Hour, MaxEntries: 3}, want: []int{1, 10}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := OpenStore(filepath.Join(t.TempDir(), "store.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			for _, age := range []int{400, 100, 10, 1} {
+				if err := store.RecordInfo(DomainInfo{Domain: "example.com"}, days(age)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Pending deliveries are still being retried, so they're kept however old they are
+			old := []Delivery{
+				{Id: "delivered", Created: days(400), State: deliveryDelivered, Event: ChangeEvent{EntryId: "entry"}},
+				{Id: "pending", Created: days(400), State: deliveryPending, Event: ChangeEvent{EntryId: "entry"}},
+			}
+			for _, delivery := range old {
+				if err := store.PutDelivery(delivery); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := store.Prune(test.retention, now); err != nil {
+				t.Fatal(err)
+			}
+
+			snapshots, err := store.InfoHistory("example.com", now, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for _, snapshot := range snapshots {
+				got = append(got, int(now.Sub(snapshot.Time).Hours()/24))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got snapshots %v days old, want %v", got, test.want)
+			}
+
+			deliveries, err := store.Deliveries("entry", now, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := make(map[string]bool)
+			for _, delivery := range deliveries {
+				kept[delivery.Id] = true
+			}
+			if !kept["pending"] {
+				t.Error("pruned a pending delivery")
+			}
+			if wantDelivered := test.retention.MaxAge == 0; kept["delivered"] != wantDelivered {
+				t.Errorf("kept the old delivered delivery: %t, want %t", kept["delivered"], wantDelivered)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Stage is one leg of a lookup pipeline that gets its own time budget.
+type Stage string
+
+const (
+	StageRegistry  Stage = "registry"
+	StageRegistrar Stage = "registrar"
+	StageWhois     Stage = "whois"
+	StageDns       Stage = "dns"
+)
+
+// These are the defaults for TimeoutConfig.
+const (
+	defaultRequestTimeout = 30 * time.Second
+	maxRequestTimeout     = 2 * time.Minute
+)
+
+// StageTimeouts is the budget for each stage of a lookup. A stage's budget is always capped by the request deadline.
+type StageTimeouts map[Stage]time.Duration
+
+var defaultStageTimeouts = StageTimeouts{
+	StageRegistry:  10 * time.Second,
+	StageRegistrar: 10 * time.Second,
+	StageWhois:     10 * time.Second,
+	StageDns:       10 * time.Second,
+}
+
+// stageContext derives a context for stage from ctx, bounded by the stage's budget.
+func stageContext(ctx context.Context, stage Stage) (context.Context, context.CancelFunc) {
+	budget, ok := config.Timeouts.Stages[stage]
+	if !ok || budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, budget)
+}
+
+// isTimeout reports whether err was caused by a stage budget or the request deadline elapsing, as opposed to the
+// upstream actually answering with a failure or the client going away.
+func isTimeout(err error) bool {
+	return ErrorCodeOf(err) == ErrCodeUpstreamTimeout
+}
+
+// parseTimeout accepts either a Go duration ("15s", "1m30s") or a bare number of seconds ("15").
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return config.Timeouts.Request, nil
+	}
+
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, invalidInput(fmt.Errorf("%q is not a valid timeout", s))
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+
+	if timeout <= 0 || timeout > config.Timeouts.MaxRequest {
+		return 0, invalidInput(fmt.Errorf("timeout must be greater than 0 and at most %s", config.Timeouts.MaxRequest))
+	}
+
+	return timeout, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/zonedb/zonedb"
+)
+
+// TldInfo is what zonedb and our own config know about a TLD, or a zone under one like co.uk, for staff to check a
+// TLD's policies before a transfer.
+type TldInfo struct {
+	Tld        string `json:"tld"`
+	TldUnicode string `json:"tldUnicode"`
+	// Parent is the TLD a zone like co.uk is under.
+	Parent string `json:"parent,omitempty"`
+	// Operator is the registry operator, which only comes from our config.
+	Operator    string `json:"operator,omitempty"`
+	WhoisServer string `json:"whoisServer,omitempty"`
+	WhoisUrl    string `json:"whoisUrl,omitempty"`
+	// Rdap says whether the registry has an RDAP server we know of, either from the bootstrap registry, our config
+	// or zonedb.
+	Rdap     bool     `json:"rdap"`
+	RdapUrls []string `json:"rdapUrls"`
+	// Tags are zonedb's, like generic, country, brand or closed, and ours.
+	Tags               []string    `json:"tags"`
+	Idn                bool        `json:"idn"`
+	AllowsRegistration bool        `json:"allowsRegistration"`
+	Delegated          bool        `json:"delegated"`
+	Subzones           []string    `json:"subzones"`
+	Nameservers        []string    `json:"nameservers"`
+	Policies           []TldPolicy `json:"policies,omitempty"`
+	// Notes are ours, like quirks of the registry's transfer process.
+	Notes string `json:"notes,omitempty"`
+}
+
+// TldPolicy is one of zonedb's policies for a zone, like an IDN table or a minimum label length.
+type TldPolicy struct {
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// zoneTags names zonedb's tags, which zonedb only spells out as one space-separated string.
+var zoneTags = []struct {
+	tag  zonedb.Tags
+	name string
+}{
+	{zonedb.TagAdult, "adult"},
+	{zonedb.TagBrand, "brand"},
+	{zonedb.TagClosed, "closed"},
+	{zonedb.TagCommunity, "community"},
+	{zonedb.TagCountry, "country"},
+	{zonedb.TagGeneric, "generic"},
+	{zonedb.TagGeo, "geo"},
+	{zonedb.TagInfrastructure, "infrastructure"},
+	{zonedb.TagPrivate, "private"},
+	{zonedb.TagRegion, "region"},
+	{zonedb.TagRetired, "retired"},
+	{zonedb.TagSponsored, "sponsored"},
+	{zonedb.TagWithdrawn, "withdrawn"},
+}
+
+// isGtld is whether domain is under a generic TLD, where ICANN's policies apply, going by zonedb. It goes by the TLD
+// rather than the public zone, since zones under a ccTLD like co.uk aren't reliably tagged as country zones.
+func isGtld(domain string) bool {
+	zone := zonedb.ZoneMap[tldOf(domain)]
+	return zone != nil && !zone.Tags.And(zonedb.TagCountry)
+}
+
+// GetTldInfo describes tld, which must be a zone zonedb knows of, or one our config describes.
+func GetTldInfo(ctx context.Context, tld string) (TldInfo, error) {
+	zone := zonedb.ZoneMap[tld]
+	override, overridden := config.Tlds[tld]
+	if zone == nil && !overridden {
+		return TldInfo{}, newLookupError(ErrCodeNotFound, fmt.Errorf("%q is not a TLD we know of", tld))
+	}
+
+	info := TldInfo{
+		Tld:        tld,
+		TldUnicode: toUnicode(tld),
+		Operator:   override.Operator,
+		Notes:      override.Notes,
+	}
+	if server, ok := config.Whois.Servers[tld]; ok {
+		info.WhoisServer = server
+	}
+
+	if zone != nil {
+		if zone.Parent != nil {
+			info.Parent = zone.Parent.Domain
+		}
+		if info.WhoisServer == "" {
+			info.WhoisServer = zone.WhoisServer()
+		}
+		info.WhoisUrl = zone.WhoisURL()
+		info.RdapUrls = slices.Clone(zone.RDAPURLs())
+		for _, t := range zoneTags {
+			if zone.Tags.And(t.tag) {
+				info.Tags = append(info.Tags, t.name)
+			}
+		}
+		info.Idn = zone.AllowsIDN()
+		info.AllowsRegistration = zone.AllowsRegistration()
+		info.Delegated = zone.IsDelegated()
+		for _, subzone := range zone.Subdomains {
+			info.Subzones = append(info.Subzones, subzone.Domain)
+		}
+		info.Nameservers = slices.Clone(zone.NameServers)
+		for _, policy := range zone.Policies {
+			info.Policies = append(info.Policies, TldPolicy(policy))
+		}
+	}
+
+	// The bootstrap registry, with our overrides, is what lookups actually use, so it beats zonedb. It failing to
+	// load isn't worth failing the request over when zonedb might know.
+	if servers, err := rdapClient.bootstrap.Lookup(ctx, tld); err == nil {
+		info.RdapUrls = make([]string, len(servers))
+		for i, server := range servers {
+			info.RdapUrls[i] = server.String()
+		}
+	} else if ErrorCodeOf(err) != ErrCodeInvalidInput {
+		loggerFrom(ctx).Warn("failed to look up RDAP servers", "tld", tld, "err", err)
+	}
+	info.Rdap = len(info.RdapUrls) > 0
+
+	for _, tag := range override.Tags {
+		if !slices.Contains(info.Tags, tag) {
+			info.Tags = append(info.Tags, tag)
+		}
+	}
+	slices.Sort(info.Tags)
+	slices.Sort(info.Subzones)
+
+	// Lists are empty rather than null when there's nothing in them
+	for _, list := range []*[]string{&info.RdapUrls, &info.Tags, &info.Subzones, &info.Nameservers} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	return info, nil
+}
+
+func tldInfo(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	tld, err := normalizeHostname(mux.Vars(req)["tld"])
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), config.Timeouts.Request)
+	defer cancel()
+
+	info, err := GetTldInfo(ctx, strings.ToLower(tld))
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// transferLockDays is how long ICANN's Transfer Policy lets a gTLD registrar refuse a transfer after the domain
+	// was registered or transferred, and how long a change of registrant locks it.
+	transferLockDays = 60
+	// transferExpiryWarningDays is how close to expiring a domain is worth warning about, since a transfer can take
+	// up to 5 days to go through and not every registrar will start one for a domain about to lapse.
+	transferExpiryWarningDays = 14
+)
+
+// TransferReadiness is whether a domain can be transferred to another registrar now, and if not, what's in the way.
+type TransferReadiness struct {
+	Domain    string `json:"domain"`
+	Registrar string `json:"registrar"`
+	Source    string `json:"source"`
+	// Ready means nothing we know of would stop a transfer started now.
+	Ready bool `json:"ready"`
+	// EarliestDate is the earliest a transfer could succeed, assuming the registrant lifts every blocker they can.
+	// It's null if a blocker has no end we can predict.
+	EarliestDate *time.Time        `json:"earliestDate"`
+	Blockers     []TransferBlocker `json:"blockers"`
+	// Warnings are things that might get in the way that we can't be sure of, like a lock the registrant may have
+	// opted out of.
+	Warnings []TransferBlocker `json:"warnings"`
+	// TimedOut lists the lookup stages that timed out, which may have hidden a blocker.
+	TimedOut []Stage `json:"timedOut,omitempty"`
+}
+
+// TransferBlocker is one reason a transfer would fail.
+type TransferBlocker struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Until is when it lifts by itself, if it does.
+	Until *time.Time `json:"until,omitempty"`
+	// Liftable means the registrant can lift it now through their registrar, like a transfer lock they set.
+	Liftable bool `json:"liftable"`
+}
+
+// transferStatuses are the EPP statuses that stop a transfer, by normalizeStatus form.
+var transferStatuses = map[string]TransferBlocker{
+	"clienttransferprohibited": {
+		Code:     "client-transfer-prohibited",
+		Message:  "the registrar has locked the domain against transfers (clientTransferProhibited); the registrant can ask them to unlock it",
+		Liftable: true,
+	},
+	"servertransferprohibited": {
+		Code:    "server-transfer-prohibited",
+		Message: "the registry has locked the domain against transfers (serverTransferProhibited), which only the registrar can ask it to lift",
+	},
+	"pendingtransfer": {
+		Code:    "pending-transfer",
+		Message: "a transfer is already in progress (pendingTransfer)",
+	},
+	"pendingdelete": {
+		Code:    "pending-delete",
+		Message: "the domain is being deleted (pendingDelete) and can't be transferred",
+	},
+	"redemptionperiod": {
+		Code:    "redemption-period",
+		Message: "the domain has been deleted and is in its redemption period (redemptionPeriod); it has to be restored before it can be transferred",
+	},
+	"pendingrestore": {
+		Code:    "pending-restore",
+		Message: "the domain is being restored from redemption (pendingRestore)",
+	},
+	"pendingcreate": {
+		Code:    "pending-create",
+		Message: "the domain hasn't finished being registered (pendingCreate)",
+	},
+}
+
+// GetTransferReadiness works out whether domain can be transferred from its statuses, dates and history. Statuses
+// are definitive; the 60-day locks are ICANN policy for gTLDs, which ccTLD registries may or may not follow, and
+// which only show up in the data as dates.
+func GetTransferReadiness(ctx context.Context, info DomainInfo, now time.Time) TransferReadiness {
+	readiness := TransferReadiness{
+		Domain:    info.Domain,
+		Registrar: info.Registrar,
+		Source:    info.Source,
+		Blockers:  make([]TransferBlocker, 0),
+		Warnings:  make([]TransferBlocker, 0),
+		TimedOut:  info.TimedOut,
+	}
+	gtld := isGtld(info.Domain)
+	// A lock that ICANN policy imposes is a blocker for gTLDs, and worth a warning for ccTLDs
+	addLock := func(lock TransferBlocker) {
+		if gtld {
+			readiness.Blockers = append(readiness.Blockers, lock)
+		} else {
+			lock.Message += " (ICANN policy for gTLDs; this registry may not apply it)"
+			readiness.Warnings = append(readiness.Warnings, lock)
+		}
+	}
+
+	for _, status := range info.Statuses {
+		if blocker, ok := transferStatuses[normalizeStatus(status)]; ok {
+			if !slices.ContainsFunc(readiness.Blockers, func(b TransferBlocker) bool { return b.Code == blocker.Code }) {
+				readiness.Blockers = append(readiness.Blockers, blocker)
+			}
+		}
+	}
+
+	if info.CreateDate != nil {
+		if until := info.CreateDate.AddDate(0, 0, transferLockDays); until.After(now) {
+			addLock(TransferBlocker{
+				Code:    "post-registration-lock",
+				Message: fmt.Sprintf("registered on %s, less than %d days ago", info.CreateDate.Format(time.DateOnly), transferLockDays),
+				Until:   &until,
+			})
+		}
+	}
+
+	// A transfer in shows up as an update, but so does every other change, so UpdateDate is only a hint unless the
+	// registry says the domain's in its transfer period
+	if info.UpdateDate != nil {
+		if until := info.UpdateDate.AddDate(0, 0, transferLockDays); until.After(now) {
+			transferred := slices.ContainsFunc(info.Statuses, func(status string) bool {
+				return normalizeStatus(status) == "transferperiod"
+			})
+			lock := TransferBlocker{
+				Code:  "post-transfer-lock",
+				Until: &until,
+			}
+			if transferred {
+				lock.Message = fmt.Sprintf("transferred on %s, less than %d days ago", info.UpdateDate.Format(time.DateOnly), transferLockDays)
+				addLock(lock)
+			} else {
+				lock.Message = fmt.Sprintf("last updated on %s; if that was a transfer, the registrar can refuse another until %s",
+					info.UpdateDate.Format(time.DateOnly), until.Format(time.DateOnly))
+				readiness.Warnings = append(readiness.Warnings, lock)
+			}
+		}
+	}
+
+	if changed, ok := registrantChangedSince(ctx, info, now, now.AddDate(0, 0, -transferLockDays)); ok {
+		until := changed.AddDate(0, 0, transferLockDays)
+		readiness.Warnings = append(readiness.Warnings, TransferBlocker{
+			Code: "registrant-change-lock",
+			Message: fmt.Sprintf("the registrant changed by %s, which locks the domain against transfers for %d days unless they opted out",
+				changed.Format(time.DateOnly), transferLockDays),
+			Until: &until,
+		})
+	}
+
+	if expiration := earliestExpiration(info); expiration != nil {
+		daysLeft := int(expiration.Sub(now).Hours() / 24)
+		switch {
+		case expiration.Before(now):
+			readiness.Blockers = append(readiness.Blockers, TransferBlocker{
+				Code:     "expired",
+				Message:  fmt.Sprintf("expired on %s; most registrars need it renewed before it can be transferred", expiration.Format(time.DateOnly)),
+				Liftable: true,
+			})
+		case daysLeft <= transferExpiryWarningDays:
+			readiness.Warnings = append(readiness.Warnings, TransferBlocker{
+				Code:    "expiring-soon",
+				Message: fmt.Sprintf("expires in %d days on %s, and a transfer can take up to 5 days", daysLeft, expiration.Format(time.DateOnly)),
+			})
+		}
+	}
+
+	readiness.Ready = len(readiness.Blockers) == 0
+	earliest := now.UTC()
+	for _, blocker := range readiness.Blockers {
+		switch {
+		case blocker.Until != nil:
+			if blocker.Until.After(earliest) {
+				earliest = blocker.Until.UTC()
+			}
+		case !blocker.Liftable:
+			return readiness
+		}
+	}
+	readiness.EarliestDate = &earliest
+	return readiness
+}
+
+// earliestExpiration is the earlier of the registry and registrar expiration dates, since either letting the domain
+// lapse loses it.
+func earliestExpiration(info DomainInfo) *time.Time {
+	registry, registrar := info.RegistryExpirationDate, info.RegistrarExpirationDate
+	if registry == nil || registrar != nil && registrar.Before(*registry) {
+		return registrar
+	}
+	return registry
+}
+
+// registrantChangedSince looks through the domain's history for the registrant's name changing after since, and
+// returns the latest it could have changed: the first time the current name was seen. Only names are compared,
+// since redacted registrants can't be told apart and adding a privacy service isn't a change of registrant, and only
+// from the same kind of lookup as info, since WHOIS can give the organization where RDAP gives the person.
+func registrantChangedSince(ctx context.Context, info DomainInfo, now time.Time, since time.Time) (time.Time, bool) {
+	if store == nil || info.RegistrantName == nil {
+		return time.Time{}, false
+	}
+
+	snapshots, err := store.InfoHistorySince(info.Domain, since, now)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to read info history", "domain", info.Domain, "err", err)
+		return time.Time{}, false
+	}
+
+	current := strings.TrimSpace(*info.RegistrantName)
+	seen := now
+	for _, snapshot := range snapshots {
+		name := snapshot.Info.RegistrantName
+		if name == nil || sourceKind(snapshot.Info.Source) != sourceKind(info.Source) {
+			continue
+		}
+		if !strings.EqualFold(strings.TrimSpace(*name), current) {
+			return seen, seen.After(since)
+		}
+		seen = snapshot.Time
+	}
+	return time.Time{}, false
+}
+
+// sourceKind is the kind of lookup a DomainInfo came from, like "RDAP" from "RDAP (https://rdap.verisign.com/com/v1/)".
+func sourceKind(source string) string {
+	kind, _, _ := strings.Cut(source, " (")
+	return kind
+}
+
+func transferReadiness(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	infoReq, err := parseInfoRequest(req)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), infoReq.Timeout)
+	defer cancel()
+
+	cached, err := lookupInfo(ctx, infoReq)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(GetTransferReadiness(ctx, cached.Info, time.Now()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
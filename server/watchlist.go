@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	watchlistBucket    = []byte("watchlist")
+	watchResultsBucket = []byte("watch-results")
+)
+
+const (
+	defaultWatchInterval = 24 * time.Hour
+	minWatchInterval     = 5 * time.Minute
+)
+
+// WatchCheck is something the scheduler can check about a watched domain.
+type WatchCheck string
+
+const (
+	// checkInfo runs GetInfo and records it in the history.
+	checkInfo WatchCheck = "info"
+	// checkDns asks every authoritative nameserver for the watched hostnames' records and records them in the history.
+	checkDns WatchCheck = "dns"
+	// checkDnssec compares what the registry says about DNSSEC with the keys the nameservers actually serve.
+	checkDnssec WatchCheck = "dnssec"
+	// checkDelegation makes sure every delegated nameserver resolves, answers authoritatively and agrees on the serial.
+	checkDelegation WatchCheck = "delegation"
+	// checkExpiry reports when the domain is about to expire, see ExpiryRules.
+	checkExpiry WatchCheck = "expiry"
+	// checkDs compares the zone's keys with the parent's DS records and reports on CDS/CDNSKEY rollovers, see DsReport.
+	checkDs WatchCheck = "ds"
+)
+
+var allWatchChecks = []WatchCheck{checkInfo, checkDns, checkDnssec, checkDelegation, checkExpiry, checkDs}
+
+// defaultExpiryDays are the ExpiryRules.Days used when an entry doesn't set any.
+var defaultExpiryDays = []int{60, 30, 7}
+
+// Duration is a time.Duration that's "1h30m" in JSON rather than a number of nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type WatchEntry struct {
+	Id     string       `json:"id"`
+	Domain string       `json:"domain"`
+	Checks []WatchCheck `json:"checks"`
+	// Hostnames are the names the DNS check looks up. Defaults to just the domain.
+	Hostnames []string `json:"hostnames"`
+	Interval  Duration `json:"interval"`
+	// Expiry configures the expiry check.
+	Expiry    ExpiryRules `json:"expiry"`
+	CreatedAt time.Time   `json:"createdAt"`
+	LastRun   *time.Time  `json:"lastRun"`
+	NextRun   time.Time   `json:"nextRun"`
+}
+
+// ExpiryRules decide when the expiry check raises an issue, which the alerter then sends out.
+type ExpiryRules struct {
+	// Days before the earlier of the registry and registrar expiration dates to alert at, once each.
+	Days []int `json:"days"`
+	// MaxDisagreementDays alerts when the registry and registrar expiration dates are further apart than this. Zero
+	// turns it off, since registrars commonly lag the registry's auto-renewal by up to a year.
+	MaxDisagreementDays int `json:"maxDisagreementDays"`
+}
+
+// WatchResult is the outcome of one check. Issues are problems the check found with the domain itself, as opposed to
+// Error which means the check couldn't be run.
+type WatchResult struct {
+	Check WatchCheck `json:"check"`
+	// Hostname is set on DNS results, which there's one of per hostname.
+	Hostname      string         `json:"hostname,omitempty"`
+	Ok            bool           `json:"ok"`
+	Code          ErrorCode      `json:"code,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	Issues        []string       `json:"issues,omitempty"`
+	Changes       []FieldChange  `json:"changes,omitempty"`
+	RecordChanges []RecordChange `json:"recordChanges,omitempty"`
+	Expiry        *ExpiryStatus  `json:"expiry,omitempty"`
+	Ds            *DsReport      `json:"ds,omitempty"`
+}
+
+// WatchRun is every check that ran for an entry at one time.
+type WatchRun struct {
+	EntryId string        `json:"entryId"`
+	Domain  string        `json:"domain"`
+	Time    time.Time     `json:"time"`
+	Results []WatchResult `json:"results"`
+}
+
+func newWatchId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validate normalizes the user-editable fields of an entry and fills in defaults.
+func (e *WatchEntry) validate() error {
+	domain, err := normalizeHostname(e.Domain)
+	if err != nil {
+		return err
+	}
+	e.Domain = domain
+
+	if len(e.Checks) == 0 {
+		e.Checks = slices.Clone(allWatchChecks)
+	}
+	for _, check := range e.Checks {
+		if !slices.Contains(allWatchChecks, check) {
+			return invalidInput(fmt.Errorf("%q is not a valid check", check))
+		}
+	}
+	slices.Sort(e.Checks)
+	e.Checks = slices.Compact(e.Checks)
+
+	if len(e.Hostnames) == 0 {
+		e.Hostnames = []string{e.Domain}
+	}
+	for i, hostname := range e.Hostnames {
+		hostname, err := normalizeHostname(hostname)
+		if err != nil {
+			return err
+		}
+		e.Hostnames[i] = hostname
+	}
+
+	if len(e.Expiry.Days) == 0 {
+		e.Expiry.Days = slices.Clone(defaultExpiryDays)
+	}
+	for _, days := range e.Expiry.Days {
+		if days <= 0 {
+			return invalidInput(errors.New("expiry days must be positive"))
+		}
+	}
+	slices.Sort(e.Expiry.Days)
+	e.Expiry.Days = slices.Compact(e.Expiry.Days)
+	slices.Reverse(e.Expiry.Days)
+	if e.Expiry.MaxDisagreementDays < 0 {
+		return invalidInput(errors.New("expiry maxDisagreementDays can't be negative"))
+	}
+
+	if e.Interval == 0 {
+		e.Interval = Duration(defaultWatchInterval)
+	}
+	if time.Duration(e.Interval) < minWatchInterval {
+		return invalidInput(fmt.Errorf("interval must be at least %s", minWatchInterval))
+	}
+
+	return nil
+}
+
+func (s *Store) PutWatch(entry WatchEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchlistBucket).Put([]byte(entry.Id), data)
+	})
+}
+
+func (s *Store) GetWatch(id string) (WatchEntry, error) {
+	var entry WatchEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(watchlistBucket).Get([]byte(id))
+		if data == nil {
+			return newLookupError(ErrCodeNotFound, fmt.Errorf("no watchlist entry %q", id))
+		}
+		return json.Unmarshal(data, &entry)
+	})
+	return entry, err
+}
+
+// UpdateWatch applies update to the stored entry id and returns the result.
+func (s *Store) UpdateWatch(id string, update func(*WatchEntry)) (WatchEntry, error) {
+	var entry WatchEntry
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(watchlistBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return newLookupError(ErrCodeNotFound, fmt.Errorf("no watchlist entry %q", id))
+		}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+
+		update(&entry)
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+	return entry, err
+}
+
+func (s *Store) ListWatches() ([]WatchEntry, error) {
+	entries := make([]WatchEntry, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchlistBucket).ForEach(func(k, v []byte) error {
+			var entry WatchEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *Store) DeleteWatch(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(watchlistBucket).Get([]byte(id)) == nil {
+			return newLookupError(ErrCodeNotFound, fmt.Errorf("no watchlist entry %q", id))
+		}
+		if err := tx.Bucket(watchlistBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(alertStateBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		for _, bucket := range [][]byte{watchResultsBucket, eventDeliveriesBucket} {
+			if tx.Bucket(bucket).Bucket([]byte(id)) == nil {
+				continue
+			}
+			if err := tx.Bucket(bucket).DeleteBucket([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) RecordWatchRun(run WatchRun) error {
+	return s.putSeries(watchResultsBucket, run.EntryId, run.Time, run)
+}
+
+func (s *Store) WatchRuns(id string, before time.Time, limit int) ([]WatchRun, error) {
+	return listSeries[WatchRun](s, watchResultsBucket, id, before, limit)
+}
+
+func decodeWatchEntry(req *http.Request) (WatchEntry, error) {
+	var entry WatchEntry
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entry); err != nil {
+		return WatchEntry{}, invalidInput(errors.New("invalid watchlist entry"), err)
+	}
+	if err := entry.validate(); err != nil {
+		return WatchEntry{}, err
+	}
+	return entry, nil
+}
+
+func listWatches(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	entries, err := store.ListWatches()
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func createWatch(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	entry, err := decodeWatchEntry(req)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	now := time.Now()
+	entry.Id = newWatchId()
+	entry.CreatedAt = now
+	entry.LastRun = nil
+	entry.NextRun = now
+	if err := store.PutWatch(entry); err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+	scheduler.Wake()
+
+	w.WriteHeader(http.StatusCreated)
+	err = encoder.Encode(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func getWatch(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	entry, err := store.GetWatch(mux.Vars(req)["id"])
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// updateWatch replaces the user-editable fields of an entry, keeping its schedule unless the domain or interval
+// changed.
+func updateWatch(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	edited, err := decodeWatchEntry(req)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	entry, err := store.UpdateWatch(mux.Vars(req)["id"], func(entry *WatchEntry) {
+		if edited.Interval != entry.Interval || edited.Domain != entry.Domain {
+			entry.NextRun = time.Now()
+		}
+		entry.Domain = edited.Domain
+		entry.Checks = edited.Checks
+		entry.Hostnames = edited.Hostnames
+		entry.Interval = edited.Interval
+		entry.Expiry = edited.Expiry
+	})
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+	scheduler.Wake()
+
+	err = encoder.Encode(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func deleteWatch(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	if err := store.DeleteWatch(mux.Vars(req)["id"]); err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listWatchRuns(w http.ResponseWriter, req *http.Request) {
+	encoder := diJsonEncoder(w)
+
+	id := mux.Vars(req)["id"]
+	if _, err := store.GetWatch(id); err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	limit, err := parseLimitParam(req.URL.Query().Get("limit"))
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	runs, err := store.WatchRuns(id, time.Now(), limit)
+	if err != nil {
+		writeError(w, encoder, err)
+		return
+	}
+
+	err = encoder.Encode(runs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/domainr/whois"
+	whoisparser "github.com/likexian/whois-parser"
+)
+
+const defaultWhoisMaxReferrals = 3
+
+// whoisQueryPlaceholder is replaced with the domain in a WHOIS query format.
+const whoisQueryPlaceholder = "{domain}"
+
+// defaultWhoisQueryFormats are for servers that answer a bare domain with something less useful than they could.
+var defaultWhoisQueryFormats = map[string]string{
+	// Without -T dn DENIC only says whether the domain is registered
+	"whois.denic.de": "-T dn,ace {domain}",
+	// JPRS answers in Japanese unless asked for English
+	"whois.jprs.jp": "{domain}/e",
+}
+
+// WhoisHop is one server asked during a WHOIS lookup, in the order they were asked. The first is the registry's,
+// the rest are the referrals it and its successors gave.
+type WhoisHop struct {
+	Source InfoSource `json:"source"`
+	Server string     `json:"server"`
+	// Error is why the server didn't give a usable answer, or wasn't asked at all.
+	Error string `json:"error,omitempty"`
+}
+
+// newWhoisRequest prepares a query for domain to host, or to the server configured or known for its TLD if host
+// is empty.
+func newWhoisRequest(domain string, host string) (*whois.Request, error) {
+	if host == "" {
+		host, _ = matchSuffix(config.Whois.Servers, domain)
+	}
+
+	request := &whois.Request{Query: domain, Host: host}
+	if err := request.Prepare(); err != nil {
+		return nil, err
+	}
+	// Servers found through the zone database can be web forms, which take the query their own way
+	if format, ok := config.Whois.QueryFormats[strings.ToLower(request.Host)]; ok && request.URL == "" {
+		request.Body = []byte(strings.ReplaceAll(format, whoisQueryPlaceholder, domain) + "\r\n")
+	}
+	return request, nil
+}
+
+// whoisReferral is the server a response refers us to for more detail, or "" if it doesn't refer us to a WHOIS
+// server at all.
+func whoisReferral(parsed *whoisparser.WhoisInfo) string {
+	if parsed.Domain == nil {
+		return ""
+	}
+
+	host := strings.TrimFunc(parsed.Domain.WhoisServer, func(r rune) bool {
+		return r == '/' || unicode.IsSpace(r)
+	})
+	host = strings.ToLower(strings.TrimPrefix(host, "whois://"))
+	if strings.Contains(host, "/") {
+		// A web page rather than a server we can query
+		return ""
+	}
+	return host
+}
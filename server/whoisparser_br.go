@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	whoisparser "github.com/likexian/whois-parser"
+)
+
+func init() {
+	RegisterWhoisParser(parseRegistroBrWhois, "br")
+}
+
+// registroBrDate is how registro.br writes dates. Creation dates are followed by a ticket number.
+const registroBrDate = "20060102"
+
+// parseRegistroBrWhois parses registro.br's format: the domain's "key: value" lines, then a block for each contact
+// starting with nic-hdl-br, whose created and changed dates are the contact's rather than the domain's.
+func parseRegistroBrWhois(text string) (whoisparser.WhoisInfo, error) {
+	if strings.Contains(text, "% No match for") {
+		return whoisparser.WhoisInfo{}, whoisparser.ErrNotFoundDomain
+	}
+
+	var info whoisparser.WhoisInfo
+	for _, line := range strings.Split(text, "\n") {
+		key, value, ok := whoisField(line)
+		if !ok {
+			continue
+		}
+		if key == "domain" {
+			if info.Domain == nil {
+				info = newParsedWhois(value)
+			}
+			continue
+		}
+		if key == "nic-hdl-br" && info.Domain != nil {
+			break
+		}
+		if info.Domain == nil || value == "" {
+			continue
+		}
+
+		switch key {
+		case "owner":
+			info.Registrant = &whoisparser.Contact{Name: value}
+		case "nserver":
+			info.Domain.NameServers = append(info.Domain.NameServers, strings.ToLower(firstField(value)))
+		case "dsrecord":
+			info.Domain.DNSSec = true
+		case "status":
+			info.Domain.Status = append(info.Domain.Status, value)
+		case "created":
+			setWhoisDate(firstField(value), registroBrDate, time.UTC, &info.Domain.CreatedDate, &info.Domain.CreatedDateInTime)
+		case "changed":
+			setWhoisDate(firstField(value), registroBrDate, time.UTC, &info.Domain.UpdatedDate, &info.Domain.UpdatedDateInTime)
+		case "expires":
+			setWhoisDate(firstField(value), registroBrDate, time.UTC, &info.Domain.ExpirationDate, &info.Domain.ExpirationDateInTime)
+		}
+	}
+
+	if info.Domain == nil {
+		return whoisparser.WhoisInfo{}, errWhoisFormat
+	}
+	return info, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	whoisparser "github.com/likexian/whois-parser"
+)
+
+func init() {
+	RegisterWhoisParser(parseDenicWhois, "de")
+}
+
+// parseDenicWhois parses DENIC's "-T dn" format, a flat list of "Key: value" lines. DENIC doesn't publish the
+// registrar or the registrant, and the only date is the last change.
+func parseDenicWhois(text string) (whoisparser.WhoisInfo, error) {
+	var info whoisparser.WhoisInfo
+	for _, line := range strings.Split(text, "\n") {
+		key, value, ok := whoisField(line)
+		if !ok {
+			continue
+		}
+		if key == "domain" {
+			if info.Domain == nil {
+				info = newParsedWhois(value)
+			}
+			continue
+		}
+		if info.Domain == nil || value == "" {
+			continue
+		}
+
+		switch key {
+		case "nserver":
+			info.Domain.NameServers = append(info.Domain.NameServers, strings.ToLower(firstField(value)))
+		case "dnskey":
+			info.Domain.DNSSec = true
+		case "status":
+			if value == "free" {
+				return whoisparser.WhoisInfo{}, whoisparser.ErrNotFoundDomain
+			}
+			info.Domain.Status = append(info.Domain.Status, value)
+		case "changed":
+			setWhoisDate(value, time.RFC3339, time.UTC, &info.Domain.UpdatedDate, &info.Domain.UpdatedDateInTime)
+		}
+	}
+
+	if info.Domain == nil {
+		return whoisparser.WhoisInfo{}, errWhoisFormat
+	}
+	return info, nil
+}
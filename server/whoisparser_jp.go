@@ -0,0 +1,88 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	whoisparser "github.com/likexian/whois-parser"
+)
+
+func init() {
+	RegisterWhoisParser(parseJprsWhois, "jp")
+}
+
+// jprsField matches a line of JPRS's English output, like "[Name Server]   ns1.example.jp". Organizational domains
+// (co.jp and the like) prefix their fields with a letter, as in "p. [Name Server]".
+var jprsField = regexp.MustCompile(`^(?:[a-z]\.\s*)?\[([^\]]+)\]\s*(.*)$`)
+
+// jprsState is an organizational domain's state, like "Connected (2025/03/31)", which is as close as it gets to an
+// expiration date.
+var jprsState = regexp.MustCompile(`^(.*?)\s*\((\d{4}/\d{2}/\d{2})\)$`)
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+const (
+	jprsDate     = "2006/01/02"
+	jprsDateTime = "2006/01/02 15:04:05 (MST)"
+)
+
+// parseJprsWhois parses JPRS's English ("/e") output. The Japanese output isn't recognized, and goes to the generic
+// parser.
+func parseJprsWhois(text string) (whoisparser.WhoisInfo, error) {
+	if strings.Contains(text, "No match!!") {
+		return whoisparser.WhoisInfo{}, whoisparser.ErrNotFoundDomain
+	}
+
+	var info whoisparser.WhoisInfo
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Contact Information:") {
+			// Names and addresses of the contacts follow, with fields that would be mistaken for the domain's
+			break
+		}
+		match := jprsField.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		key, value := strings.ToLower(match[1]), strings.TrimSpace(match[2])
+		if key == "domain name" {
+			if info.Domain == nil {
+				info = newParsedWhois(value)
+			}
+			continue
+		}
+		if info.Domain == nil || value == "" {
+			continue
+		}
+
+		switch key {
+		case "registrant", "organization":
+			info.Registrant = &whoisparser.Contact{Name: value}
+		case "name server":
+			info.Domain.NameServers = append(info.Domain.NameServers, strings.ToLower(firstField(value)))
+		case "signing key":
+			info.Domain.DNSSec = true
+		case "status", "lock status":
+			info.Domain.Status = append(info.Domain.Status, value)
+		case "state":
+			if state := jprsState.FindStringSubmatch(value); state != nil {
+				info.Domain.Status = append(info.Domain.Status, state[1])
+				setWhoisDate(state[2], jprsDate, jst, &info.Domain.ExpirationDate, &info.Domain.ExpirationDateInTime)
+			} else {
+				info.Domain.Status = append(info.Domain.Status, value)
+			}
+		case "created on", "registered date":
+			setWhoisDate(value, jprsDate, jst, &info.Domain.CreatedDate, &info.Domain.CreatedDateInTime)
+		case "expires on":
+			setWhoisDate(value, jprsDate, jst, &info.Domain.ExpirationDate, &info.Domain.ExpirationDateInTime)
+		case "last updated", "last update":
+			setWhoisDate(value, jprsDateTime, jst, &info.Domain.UpdatedDate, &info.Domain.UpdatedDateInTime)
+		}
+	}
+
+	if info.Domain == nil {
+		return whoisparser.WhoisInfo{}, errWhoisFormat
+	}
+	return info, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	whoisparser "github.com/likexian/whois-parser"
+)
+
+func init() {
+	RegisterWhoisParser(parseNominetWhois, "uk")
+}
+
+// nominetTag is the tag Nominet appends to registrar names, as in "Example Ltd [Tag = EXAMPLE]".
+var nominetTag = regexp.MustCompile(`\s*\[Tag = [^\]]*\]$`)
+
+const nominetDate = "02-Jan-2006"
+
+// parseNominetWhois parses Nominet's format, where each field is a heading on a line of its own with its values
+// indented on the lines below it.
+func parseNominetWhois(text string) (whoisparser.WhoisInfo, error) {
+	if strings.Contains(text, "No match for \"") {
+		return whoisparser.WhoisInfo{}, whoisparser.ErrNotFoundDomain
+	}
+
+	var info whoisparser.WhoisInfo
+	section := ""
+	for _, line := range strings.Split(text, "\n") {
+		value := strings.TrimSpace(line)
+		if value == "" {
+			continue
+		}
+		if value == "--" || strings.HasPrefix(value, "WHOIS lookup made at") {
+			// The terms of use follow
+			break
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent <= 4 && strings.HasSuffix(value, ":") {
+			section = strings.ToLower(strings.TrimSuffix(value, ":"))
+			continue
+		}
+
+		if section == "domain name" {
+			if info.Domain == nil {
+				info = newParsedWhois(value)
+			}
+			continue
+		}
+		if info.Domain == nil {
+			continue
+		}
+
+		switch section {
+		case "registrant":
+			if info.Registrant == nil {
+				info.Registrant = &whoisparser.Contact{Name: value}
+			}
+		case "registrar":
+			if key, url, ok := whoisField(value); ok && key == "url" {
+				if info.Registrar != nil {
+					info.Registrar.ReferralURL = url
+				}
+			} else if info.Registrar == nil {
+				info.Registrar = &whoisparser.Contact{Name: nominetTag.ReplaceAllString(value, "")}
+			}
+		case "relevant dates":
+			key, date, _ := whoisField(value)
+			switch key {
+			case "registered on":
+				setWhoisDate(date, nominetDate, time.UTC, &info.Domain.CreatedDate, &info.Domain.CreatedDateInTime)
+			case "expiry date":
+				setWhoisDate(date, nominetDate, time.UTC, &info.Domain.ExpirationDate, &info.Domain.ExpirationDateInTime)
+			case "last updated":
+				setWhoisDate(date, nominetDate, time.UTC, &info.Domain.UpdatedDate, &info.Domain.UpdatedDateInTime)
+			}
+		case "registration status":
+			info.Domain.Status = append(info.Domain.Status, strings.TrimSuffix(value, "."))
+		case "name servers":
+			if !strings.HasPrefix(value, "No name servers listed") {
+				info.Domain.NameServers = append(info.Domain.NameServers, strings.ToLower(firstField(value)))
+			}
+		case "dnssec":
+			info.Domain.DNSSec = strings.EqualFold(value, "signed")
+		}
+	}
+
+	if info.Domain == nil {
+		return whoisparser.WhoisInfo{}, errWhoisFormat
+	}
+	return info, nil
+}
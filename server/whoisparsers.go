@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	whoisparser "github.com/likexian/whois-parser"
+)
+
+// WhoisParser parses the WHOIS format of particular TLDs. It returns errWhoisFormat if text isn't in the format it
+// knows, so the generic parser can have a go, and whoisparser's errors (ErrNotFoundDomain and so on) for responses
+// it understands to be saying there's nothing to parse.
+type WhoisParser func(text string) (whoisparser.WhoisInfo, error)
+
+var errWhoisFormat = errors.New("unrecognized WHOIS format")
+
+// whoisParsers are keyed by TLD.
+var whoisParsers = map[string]WhoisParser{}
+
+// RegisterWhoisParser makes parser the first choice for domains in tlds.
+func RegisterWhoisParser(parser WhoisParser, tlds ...string) {
+	for _, tld := range tlds {
+		whoisParsers[tld] = parser
+	}
+}
+
+// parseWhois parses a WHOIS response about domain with the parser registered for its TLD, or the generic parser if
+// there isn't one or it doesn't recognize the response.
+func parseWhois(domain string, text string) (whoisparser.WhoisInfo, error) {
+	if parser, ok := whoisParsers[tldOf(strings.ToLower(domain))]; ok {
+		info, err := parser(text)
+		if !errors.Is(err, errWhoisFormat) {
+			return info, err
+		}
+	}
+	return whoisparser.Parse(text)
+}
+
+// newParsedWhois starts the WhoisInfo for domain, split the way the generic parser splits it.
+func newParsedWhois(domain string) whoisparser.WhoisInfo {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	name, extension, _ := strings.Cut(domain, ".")
+	return whoisparser.WhoisInfo{
+		Domain: &whoisparser.Domain{Domain: domain, Name: name, Extension: extension},
+	}
+}
+
+// setWhoisDate parses value with layout in loc, and sets date and dateInTime from it if it parses.
+func setWhoisDate(value string, layout string, loc *time.Location, date *string, dateInTime **time.Time) {
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return
+	}
+	*date = value
+	*dateInTime = &t
+}
+
+// whoisField splits a "key: value" line, skipping comments. The key is lowercased.
+func whoisField(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "%") || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	key, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value), true
+}
+
+// firstField is the part of value before any whitespace, for name server lines that go on to list glue addresses.
+func firstField(value string) string {
+	if fields := strings.Fields(value); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	whoisparser "github.com/likexian/whois-parser"
+)
+
+// parsedWhois is the part of a WhoisInfo the TLD parsers fill in, with dates in RFC 3339 so they read easily in the
+// test cases.
+type parsedWhois struct {
+	Domain      string
+	NameServers []string
+	Status      []string
+	Created     string
+	Updated     string
+	Expires     string
+	Registrant  string
+	Registrar   string
+}
+
+func summarizeWhois(info whoisparser.WhoisInfo) parsedWhois {
+	date := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	var parsed parsedWhois
+	if info.Domain != nil {
+		parsed.Domain = info.Domain.Domain
+		parsed.NameServers = info.Domain.NameServers
+		parsed.Status = info.Domain.Status
+		parsed.Created = date(info.Domain.CreatedDateInTime)
+		parsed.Updated = date(info.Domain.UpdatedDateInTime)
+		parsed.Expires = date(info.Domain.ExpirationDateInTime)
+	}
+	if info.Registrant != nil {
+		parsed.Registrant = info.Registrant.Name
+	}
+	if info.Registrar != nil {
+		parsed.Registrar = info.Registrar.Name
+	}
+	return parsed
+}
+
+func readWhoisFixture(t *testing.T, name string) string {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "whois", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestWhoisParsers(t *testing.T) {
+	tests := []struct {
+		fixture string
+		domain  string
+		want    parsedWhois
+		wantErr error
+	}{
+		{
+			fixture: "de_google.de.txt",
+			domain:  "google.de",
+			want: parsedWhois{
+				Domain:      "google.de",
+				NameServers: []string{"ns1.google.com", "ns2.google.com", "ns3.google.com", "ns4.google.com"},
+				Status:      []string{"connect"},
+				Updated:     "2018-03-12T20:44:25Z",
+			},
+		},
+		{
+			fixture: "de_notfound.de.txt",
+			domain:  "likexian-have-no-money-to-register.de",
+			wantErr: whoisparser.ErrNotFoundDomain,
+		},
+		{
+			// JPRS gives times in JST, which has to come out 9 hours earlier in UTC
+			fixture: "jp_google.jp.txt",
+			domain:  "google.jp",
+			want: parsedWhois{
+				Domain:      "google.jp",
+				NameServers: []string{"ns1.google.com", "ns2.google.com", "ns3.google.com", "ns4.google.com"},
+				Status:      []string{"Active"},
+				Created:     "2005-05-29T15:00:00Z",
+				Updated:     "2017-05-31T16:05:09Z",
+				Expires:     "2018-05-30T15:00:00Z",
+				Registrant:  "Google Inc.",
+			},
+		},
+		{
+			// Organizational domains prefix their fields with a letter and give the expiry as part of the state
+			fixture: "jp_google.co.jp.txt",
+			domain:  "google.co.jp",
+			want: parsedWhois{
+				Domain:      "google.co.jp",
+				NameServers: []string{"ns1.google.com", "ns2.google.com", "ns3.google.com", "ns4.google.com"},
+				Status:      []string{"Connected", "AgentChangeLocked"},
+				Created:     "2001-03-21T15:00:00Z",
+				Updated:     "2023-03-31T16:05:57Z",
+				Expires:     "2024-03-30T15:00:00Z",
+				Registrant:  "Google Japan G.K.",
+			},
+		},
+		{
+			fixture: "jp_notfound.jp.txt",
+			domain:  "likexian-have-no-money-to-register.jp",
+			wantErr: whoisparser.ErrNotFoundDomain,
+		},
+		{
+			// The contact blocks after nic-hdl-br have created and changed dates of their own
+			fixture: "br_espm.br.txt",
+			domain:  "espm.br",
+			want: parsedWhois{
+				Domain: "espm.br",
+				NameServers: []string{
+					"ns-1434.awsdns-51.org", "ns-340.awsdns-42.com", "ns-1751.awsdns-26.co.uk", "ns-538.awsdns-03.net",
+				},
+				Status:     []string{"published"},
+				Created:    "1996-12-06T00:00:00Z",
+				Updated:    "2015-04-27T00:00:00Z",
+				Registrant: "ASSOC.ESC. SUPERIOR DE PROPAGANDA E MARKETING - SP",
+			},
+		},
+		{
+			fixture: "br_notfound.br.txt",
+			domain:  "likexian-have-no-money-to-register.br",
+			wantErr: whoisparser.ErrNotFoundDomain,
+		},
+		{
+			fixture: "uk_google.uk.txt",
+			domain:  "google.uk",
+			want: parsedWhois{
+				Domain:      "google.uk",
+				NameServers: []string{"ns1.googledomains.com", "ns2.googledomains.com", "ns3.googledomains.com", "ns4.googledomains.com"},
+				Status:      []string{"Registered until expiry date"},
+				Created:     "2014-06-11T00:00:00Z",
+				Updated:     "2019-05-10T00:00:00Z",
+				Expires:     "2020-06-11T00:00:00Z",
+				Registrar:   "Markmonitor Inc. t/a MarkMonitor Inc.",
+			},
+		},
+		{
+			// Name servers are followed by their glue addresses
+			fixture: "uk_git.uk.txt",
+			domain:  "git.uk",
+			want: parsedWhois{
+				Domain:      "git.uk",
+				NameServers: []string{"ns.123-reg.co.uk", "ns2.123-reg.co.uk"},
+				Status:      []string{"Registered until expiry date"},
+				Created:     "2017-10-22T00:00:00Z",
+				Updated:     "2019-06-29T00:00:00Z",
+				Expires:     "2019-10-22T00:00:00Z",
+				Registrar:   "123-Reg Limited t/a 123-reg",
+			},
+		},
+		{
+			fixture: "uk_notfound.uk.txt",
+			domain:  "likexian-have-no-money-to-register.uk",
+			wantErr: whoisparser.ErrNotFoundDomain,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			text := readWhoisFixture(t, test.fixture)
+			parser, ok := whoisParsers[tldOf(test.domain)]
+			if !ok {
+				t.Fatalf("no parser registered for %s", test.domain)
+			}
+
+			info, err := parser(text)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := summarizeWhois(info); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got  %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseWhoisFallsBackToGeneric(t *testing.T) {
+	// A response the TLD's parser doesn't recognize, like a registrar's in the gTLD format, goes to the generic parser
+	text := readWhoisFixture(t, "com_google.com.txt")
+	if _, err := whoisParsers["de"](text); !errors.Is(err, errWhoisFormat) {
+		t.Fatalf("got error %v from the DENIC parser, want errWhoisFormat", err)
+	}
+
+	info, err := parseWhois("google.de", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Domain == nil || info.Domain.Domain != "google.com" {
+		t.Errorf("got domain %+v, want google.com from the generic parser", info.Domain)
+	}
+	if info.Registrar == nil || info.Registrar.ID != "292" {
+		t.Errorf("got registrar %+v, want IANA ID 292 from the generic parser", info.Registrar)
+	}
+}